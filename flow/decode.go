@@ -0,0 +1,281 @@
+/*
+ * decode.go
+ *
+ * Header parsing for the frames we're given. We only care about getting from
+ * the raw frame to the TCP payload, so this is not a general purpose decoder,
+ * just enough to find addresses, ports and where the data starts.
+ *
+ */
+
+package flow
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Link layer types as returned by pcap_datalink. These are the DLT_ values,
+// which for the ones we care about are the same as LINKTYPE_ values except
+// for raw IP, which has a couple of historical numbers.
+const (
+	DLT_NULL         = 0
+	DLT_EN10MB       = 1
+	DLT_RAW          = 12
+	DLT_RAW_OPENBSD  = 14
+	DLT_LINKTYPE_RAW = 101
+	DLT_LOOP         = 108
+	DLT_LINUX_SLL    = 113
+	DLT_IPV4         = 228
+	DLT_IPV6         = 229
+	DLT_LINUX_SLL2   = 276
+)
+
+const (
+	ETHERTYPE_IPV4     = 0x0800
+	ETHERTYPE_IPV6     = 0x86DD
+	ETHERTYPE_VLAN     = 0x8100
+	ETHERTYPE_QINQ     = 0x88A8
+	ETHERTYPE_QINQ_OLD = 0x9100
+
+	IPPROTO_TCP = 6
+
+	// IPv6 extension headers we know how to step over.
+	IPV6_HOPOPTS  = 0
+	IPV6_ROUTING  = 43
+	IPV6_FRAGMENT = 44
+	IPV6_ESP      = 50
+	IPV6_AH       = 51
+	IPV6_NONEXT   = 59
+	IPV6_DSTOPTS  = 60
+	IPV6_MOBILITY = 135
+	IPV6_HIP      = 139
+	IPV6_SHIM6    = 140
+)
+
+// Reasons a frame can't be turned into a TCP segment. Tracker.Packet returns
+// these for anything it skips.
+var (
+	ErrTruncated = errors.New("truncated packet")
+	ErrNotTCP    = errors.New("not a TCP packet")
+	ErrFragment  = errors.New("non-initial IP fragment")
+	ErrNotIP     = errors.New("not an IP packet")
+	ErrOtherPort = errors.New("segment isn't to or from the server port")
+)
+
+// A linkDecoder strips the link layer off of a captured frame and returns the
+// bytes starting at the IP header.
+type linkDecoder func(data []byte) ([]byte, error)
+
+// getLinkDecoder returns the decoder for the given pcap datalink type.
+func getLinkDecoder(dlt int) (linkDecoder, error) {
+	switch dlt {
+	case DLT_EN10MB:
+		return decodeEthernet, nil
+	case DLT_LINUX_SLL:
+		return decodeLinuxSLL, nil
+	case DLT_LINUX_SLL2:
+		return decodeLinuxSLL2, nil
+	case DLT_NULL, DLT_LOOP:
+		// The loopback header is the address family, but its value for IPv6
+		// varies by platform (and it's host byte order for DLT_NULL), so we
+		// just let the IP version nibble sort it out.
+		return skipHeader(4), nil
+	case DLT_RAW, DLT_RAW_OPENBSD, DLT_LINKTYPE_RAW, DLT_IPV4, DLT_IPV6:
+		return skipHeader(0), nil
+	}
+	return nil, fmt.Errorf("unsupported link type %d", dlt)
+}
+
+func skipHeader(n int) linkDecoder {
+	return func(data []byte) ([]byte, error) {
+		if len(data) < n {
+			return nil, ErrTruncated
+		}
+		return data[n:], nil
+	}
+}
+
+// Ethernet frame has 14 bytes of stuff to ignore, the last two of which are
+// the ethertype. 802.1Q tags sit in front of the real ethertype.
+func decodeEthernet(data []byte) ([]byte, error) {
+	if len(data) < 14 {
+		return nil, ErrTruncated
+	}
+	return decodeEthertype(data, 12)
+}
+
+// Linux "cooked" capture, which is what you get from '-i any'. The protocol
+// is in the last two bytes of the 16 byte header.
+func decodeLinuxSLL(data []byte) ([]byte, error) {
+	if len(data) < 16 {
+		return nil, ErrTruncated
+	}
+	return decodeEthertype(data, 14)
+}
+
+// Version 2 of the cooked header is 20 bytes and puts the protocol first.
+func decodeLinuxSLL2(data []byte) ([]byte, error) {
+	if len(data) < 20 {
+		return nil, ErrTruncated
+	}
+	etype := uint16(data[0])<<8 + uint16(data[1])
+	if etype == ETHERTYPE_IPV4 || etype == ETHERTYPE_IPV6 {
+		return data[20:], nil
+	}
+	return nil, ErrNotIP
+}
+
+// decodeEthertype reads the ethertype at pos, skipping over as many VLAN tags
+// as there are, and returns the payload if it's IP.
+func decodeEthertype(data []byte, pos int) ([]byte, error) {
+	for {
+		if pos+2 > len(data) {
+			return nil, ErrTruncated
+		}
+
+		etype := uint16(data[pos])<<8 + uint16(data[pos+1])
+		switch etype {
+		case ETHERTYPE_IPV4, ETHERTYPE_IPV6:
+			return data[pos+2:], nil
+		case ETHERTYPE_VLAN, ETHERTYPE_QINQ, ETHERTYPE_QINQ_OLD:
+			// Each tag is 2 bytes of TCI followed by the next ethertype.
+			pos += 4
+		default:
+			return nil, ErrNotIP
+		}
+	}
+}
+
+// decodeIP takes the bytes starting at an IP header (either version, we look
+// at the version nibble to figure out which) and returns the addresses along
+// with the bytes of the TCP segment that follows it.
+func decodeIP(data []byte) (srcIP, dstIP net.IP, segment []byte, err error) {
+	if len(data) < 1 {
+		return nil, nil, nil, ErrTruncated
+	}
+
+	switch data[0] >> 4 {
+	case 4:
+		return decodeIPv4(data)
+	case 6:
+		return decodeIPv6(data)
+	}
+	return nil, nil, nil, errors.New("unknown IP version")
+}
+
+func decodeIPv4(data []byte) (srcIP, dstIP net.IP, segment []byte, err error) {
+	if len(data) < 20 {
+		return nil, nil, nil, ErrTruncated
+	}
+
+	// The IP frame has the header length in bits 4-7 of byte 0 (relative).
+	ihl := int(data[0]&0x0F) * 4
+	if ihl < 20 || len(data) < ihl {
+		return nil, nil, nil, ErrTruncated
+	}
+	if data[9] != IPPROTO_TCP {
+		return nil, nil, nil, ErrNotTCP
+	}
+
+	// Anything but the first fragment won't have a TCP header on it.
+	if (uint16(data[6])<<8+uint16(data[7]))&0x1FFF != 0 {
+		return nil, nil, nil, ErrFragment
+	}
+
+	// Trim to the total length so that we don't treat link layer padding as
+	// payload. A total length of 0 happens with TSO, so trust the capture.
+	end := int(uint16(data[2])<<8 + uint16(data[3]))
+	if end == 0 || end > len(data) {
+		end = len(data)
+	}
+	if end < ihl {
+		return nil, nil, nil, ErrTruncated
+	}
+
+	return net.IP(data[12:16]), net.IP(data[16:20]), data[ihl:end], nil
+}
+
+func decodeIPv6(data []byte) (srcIP, dstIP net.IP, segment []byte, err error) {
+	if len(data) < 40 {
+		return nil, nil, nil, ErrTruncated
+	}
+
+	// Same deal as IPv4, the payload length lets us ignore padding. It's zero
+	// for jumbograms, which we don't bother to parse out of the hop-by-hop
+	// options.
+	end := 40 + int(uint16(data[4])<<8+uint16(data[5]))
+	if end == 40 || end > len(data) {
+		end = len(data)
+	}
+
+	// Walk the chain of extension headers until we get to TCP.
+	next, pos := data[6], 40
+	for next != IPPROTO_TCP {
+		if pos+8 > end {
+			return nil, nil, nil, ErrTruncated
+		}
+
+		switch next {
+		case IPV6_HOPOPTS, IPV6_ROUTING, IPV6_DSTOPTS, IPV6_MOBILITY,
+			IPV6_HIP, IPV6_SHIM6:
+			// Length is in 8-octet units, not counting the first 8.
+			next, pos = data[pos], pos+(int(data[pos+1])+1)*8
+		case IPV6_AH:
+			// Length is in 4-octet units, not counting the first 8.
+			next, pos = data[pos], pos+(int(data[pos+1])+2)*4
+		case IPV6_FRAGMENT:
+			if (uint16(data[pos+2])<<8+uint16(data[pos+3]))&0xFFF8 != 0 {
+				return nil, nil, nil, ErrFragment
+			}
+			next, pos = data[pos], pos+8
+		default:
+			// ESP, no next header, or something we don't understand.
+			return nil, nil, nil, ErrNotTCP
+		}
+	}
+	if pos > end {
+		return nil, nil, nil, ErrTruncated
+	}
+
+	return net.IP(data[8:24]), net.IP(data[24:40]), data[pos:end], nil
+}
+
+// TCP flags we pay attention to.
+const (
+	TCP_FIN = 0x01
+	TCP_SYN = 0x02
+	TCP_RST = 0x04
+)
+
+// A tcpSegment is the part of a TCP header we need to reassemble streams.
+type tcpSegment struct {
+	srcPort uint16
+	dstPort uint16
+	seq     uint32
+	flags   byte
+	payload []byte
+}
+
+// decodeTCP returns the ports, sequence number, flags and payload of a TCP
+// segment.
+func decodeTCP(data []byte) (*tcpSegment, error) {
+	if len(data) < 20 {
+		return nil, ErrTruncated
+	}
+
+	// The TCP frame has the data offset in bits 4-7 of byte 12 (relative).
+	offset := int(data[12]>>4) * 4
+	if offset < 20 || offset > len(data) {
+		return nil, ErrTruncated
+	}
+
+	return &tcpSegment{
+		srcPort: uint16(data[0])<<8 + uint16(data[1]),
+		dstPort: uint16(data[2])<<8 + uint16(data[3]),
+		seq: uint32(data[4])<<24 + uint32(data[5])<<16 + uint32(data[6])<<8 +
+			uint32(data[7]),
+		flags:   data[13],
+		payload: data[offset:],
+	}, nil
+}
@@ -0,0 +1,311 @@
+package flow
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+var (
+	clientIPv4 = net.IP{10, 0, 0, 1}
+	serverIPv4 = net.IP{10, 0, 0, 2}
+	clientIPv6 = net.ParseIP("2001:db8::1")
+	serverIPv6 = net.ParseIP("2001:db8::2")
+)
+
+// tcpHeader builds a TCP segment. opts has to be a multiple of 4 bytes.
+func tcpHeader(sport, dport uint16, seq uint32, flags byte, opts,
+	payload []byte) []byte {
+	b := make([]byte, 20, 20+len(opts)+len(payload))
+	b[0], b[1], b[2], b[3] = byte(sport>>8), byte(sport), byte(dport>>8),
+		byte(dport)
+	b[4], b[5], b[6], b[7] = byte(seq>>24), byte(seq>>16), byte(seq>>8),
+		byte(seq)
+	b[12] = byte((20+len(opts))/4) << 4
+	b[13] = flags
+	return append(append(b, opts...), payload...)
+}
+
+// ipv4Packet wraps a segment in an IPv4 header with the given options, which
+// have to be a multiple of 4 bytes.
+func ipv4Packet(src, dst net.IP, opts []byte, proto byte, segment []byte) []byte {
+	ihl := 20 + len(opts)
+	b := make([]byte, 20, ihl+len(segment))
+	b[0] = 0x40 | byte(ihl/4)
+	b[2], b[3] = byte((ihl+len(segment))>>8), byte(ihl+len(segment))
+	b[8], b[9] = 64, proto
+	copy(b[12:16], src.To4())
+	copy(b[16:20], dst.To4())
+	return append(append(b, opts...), segment...)
+}
+
+// ipv6Packet wraps a segment in an IPv6 header and the given extension
+// headers, the first of which is next.
+func ipv6Packet(src, dst net.IP, next byte, exts, segment []byte) []byte {
+	b := make([]byte, 40, 40+len(exts)+len(segment))
+	b[0] = 0x60
+	b[4], b[5] = byte((len(exts)+len(segment))>>8), byte(len(exts)+len(segment))
+	b[6], b[7] = next, 64
+	copy(b[8:24], src.To16())
+	copy(b[24:40], dst.To16())
+	return append(append(b, exts...), segment...)
+}
+
+// extHeader builds an IPv6 extension header of size bytes with the given
+// next header and length fields.
+func extHeader(next, length byte, size int) []byte {
+	b := make([]byte, size)
+	b[0], b[1] = next, length
+	return b
+}
+
+// fragHeader builds an IPv6 fragment header. offset is in 8 byte units.
+func fragHeader(next byte, offset uint16, more bool) []byte {
+	b := make([]byte, 8)
+	b[0] = next
+	off := offset << 3
+	if more {
+		off |= 1
+	}
+	b[2], b[3] = byte(off>>8), byte(off)
+	return b
+}
+
+func TestLinkDecoders(t *testing.T) {
+	ip4 := ipv4Packet(clientIPv4, serverIPv4, nil, IPPROTO_TCP,
+		tcpHeader(40000, 8087, 1, 0, nil, []byte("x")))
+	ip6 := ipv6Packet(clientIPv6, serverIPv6, IPPROTO_TCP, nil,
+		tcpHeader(40000, 8087, 1, 0, nil, []byte("x")))
+	macs := make([]byte, 12)
+	cat := func(bufs ...[]byte) []byte {
+		var ret []byte
+		for _, buf := range bufs {
+			ret = append(ret, buf...)
+		}
+		return ret
+	}
+	sll := func(etype uint16) []byte {
+		b := make([]byte, 16)
+		b[14], b[15] = byte(etype>>8), byte(etype)
+		return b
+	}
+	sll2 := func(etype uint16) []byte {
+		b := make([]byte, 20)
+		b[0], b[1] = byte(etype>>8), byte(etype)
+		return b
+	}
+
+	tests := []struct {
+		name  string
+		dlt   int
+		frame []byte
+		want  []byte
+		err   error
+	}{
+		{"ethernet", DLT_EN10MB, cat(macs, []byte{0x08, 0x00}, ip4), ip4, nil},
+		{"ethernet v6", DLT_EN10MB, cat(macs, []byte{0x86, 0xdd}, ip6), ip6, nil},
+		{"vlan", DLT_EN10MB,
+			cat(macs, []byte{0x81, 0x00, 0, 5, 0x08, 0x00}, ip4), ip4, nil},
+		{"qinq", DLT_EN10MB, cat(macs, []byte{0x88, 0xa8, 0, 5, 0x81, 0x00, 0, 6,
+			0x86, 0xdd}, ip6), ip6, nil},
+		{"old qinq", DLT_EN10MB, cat(macs, []byte{0x91, 0x00, 0, 5, 0x81, 0x00,
+			0, 6, 0x08, 0x00}, ip4), ip4, nil},
+		{"arp", DLT_EN10MB, cat(macs, []byte{0x08, 0x06}, ip4), nil, ErrNotIP},
+		{"vlan arp", DLT_EN10MB,
+			cat(macs, []byte{0x81, 0x00, 0, 5, 0x08, 0x06}, ip4), nil, ErrNotIP},
+		{"short ethernet", DLT_EN10MB, cat(macs, []byte{0x08}), nil,
+			ErrTruncated},
+		{"short vlan", DLT_EN10MB, cat(macs, []byte{0x81, 0x00, 0, 5, 0x08}),
+			nil, ErrTruncated},
+		{"sll", DLT_LINUX_SLL, cat(sll(ETHERTYPE_IPV4), ip4), ip4, nil},
+		{"sll v6", DLT_LINUX_SLL, cat(sll(ETHERTYPE_IPV6), ip6), ip6, nil},
+		{"sll vlan", DLT_LINUX_SLL, cat(sll(ETHERTYPE_VLAN), []byte{0, 5, 0x08,
+			0x00}, ip4), ip4, nil},
+		{"sll arp", DLT_LINUX_SLL, cat(sll(0x0806), ip4), nil, ErrNotIP},
+		{"short sll", DLT_LINUX_SLL, sll(ETHERTYPE_IPV4)[:15], nil,
+			ErrTruncated},
+		{"sll2", DLT_LINUX_SLL2, cat(sll2(ETHERTYPE_IPV4), ip4), ip4, nil},
+		{"sll2 v6", DLT_LINUX_SLL2, cat(sll2(ETHERTYPE_IPV6), ip6), ip6, nil},
+		{"sll2 arp", DLT_LINUX_SLL2, cat(sll2(0x0806), ip4), nil, ErrNotIP},
+		{"short sll2", DLT_LINUX_SLL2, sll2(ETHERTYPE_IPV4)[:19], nil,
+			ErrTruncated},
+		{"null", DLT_NULL, cat([]byte{2, 0, 0, 0}, ip4), ip4, nil},
+		{"null v6", DLT_NULL, cat([]byte{30, 0, 0, 0}, ip6), ip6, nil},
+		{"loop", DLT_LOOP, cat([]byte{0, 0, 0, 2}, ip4), ip4, nil},
+		{"short null", DLT_NULL, []byte{2, 0, 0}, nil, ErrTruncated},
+		{"raw", DLT_RAW, ip4, ip4, nil},
+		{"raw openbsd", DLT_RAW_OPENBSD, ip6, ip6, nil},
+		{"linktype raw", DLT_LINKTYPE_RAW, ip4, ip4, nil},
+		{"ipv4", DLT_IPV4, ip4, ip4, nil},
+		{"ipv6", DLT_IPV6, ip6, ip6, nil},
+	}
+
+	for _, test := range tests {
+		decode, err := getLinkDecoder(test.dlt)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		got, err := decode(test.frame)
+		if err != test.err {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	if _, err := getLinkDecoder(105); err == nil {
+		t.Error("802.11 didn't fail")
+	}
+	if _, err := NewTracker(105, 8087, nil); err == nil {
+		t.Error("NewTracker with 802.11 didn't fail")
+	}
+}
+
+func TestDecodeIPv4(t *testing.T) {
+	segment := tcpHeader(40000, 8087, 1, 0, nil, []byte("hello"))
+	packet := func(opts []byte) []byte {
+		return ipv4Packet(clientIPv4, serverIPv4, opts, IPPROTO_TCP, segment)
+	}
+	with := func(b []byte, f func(b []byte)) []byte {
+		b = append([]byte{}, b...)
+		f(b)
+		return b
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want []byte
+		err  error
+	}{
+		{"plain", packet(nil), segment, nil},
+		{"options", packet([]byte{1, 1, 1, 0}), segment, nil},
+		{"max options", packet(make([]byte, 40)), segment, nil},
+		{"padding", append(packet(nil), 0, 0, 0, 0), segment, nil},
+		{"tso", with(packet(nil), func(b []byte) { b[2], b[3] = 0, 0 }),
+			segment, nil},
+		{"total past capture", with(packet(nil),
+			func(b []byte) { b[2], b[3] = 1, 0 }), segment, nil},
+		{"first fragment", with(packet(nil), func(b []byte) { b[6] = 0x20 }),
+			segment, nil},
+		{"later fragment", with(packet(nil), func(b []byte) { b[7] = 1 }),
+			nil, ErrFragment},
+		{"last fragment", with(packet(nil),
+			func(b []byte) { b[6], b[7] = 0, 0xb9 }), nil, ErrFragment},
+		{"udp", ipv4Packet(clientIPv4, serverIPv4, nil, 17, segment), nil,
+			ErrNotTCP},
+		{"short header", packet(nil)[:19], nil, ErrTruncated},
+		{"short options", packet(make([]byte, 8))[:24], nil, ErrTruncated},
+		{"small ihl", with(packet(nil), func(b []byte) { b[0] = 0x44 }), nil,
+			ErrTruncated},
+		{"total under ihl", with(packet(nil),
+			func(b []byte) { b[2], b[3] = 0, 10 }), nil, ErrTruncated},
+		{"empty", nil, nil, ErrTruncated},
+	}
+
+	for _, test := range tests {
+		src, dst, got, err := decodeIP(test.data)
+		if err != test.err {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+		if err == nil && (!src.Equal(clientIPv4) || !dst.Equal(serverIPv4)) {
+			t.Errorf("%s: addresses %s %s", test.name, src, dst)
+		}
+	}
+
+	if _, _, _, err := decodeIP([]byte{0x50, 0, 0, 0}); err == nil {
+		t.Error("IP version 5 didn't fail")
+	}
+}
+
+func TestDecodeIPv6(t *testing.T) {
+	segment := tcpHeader(40000, 8087, 1, 0, nil, []byte("hello"))
+	packet := func(next byte, exts ...[]byte) []byte {
+		var chain []byte
+		for _, ext := range exts {
+			chain = append(chain, ext...)
+		}
+		return ipv6Packet(clientIPv6, serverIPv6, next, chain, segment)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want []byte
+		err  error
+	}{
+		{"plain", packet(IPPROTO_TCP), segment, nil},
+		{"padding", append(packet(IPPROTO_TCP), 0, 0), segment, nil},
+		{"hop-by-hop", packet(IPV6_HOPOPTS, extHeader(IPPROTO_TCP, 0, 8)),
+			segment, nil},
+		{"long hop-by-hop", packet(IPV6_HOPOPTS, extHeader(IPPROTO_TCP, 2, 24)),
+			segment, nil},
+		{"chain", packet(IPV6_HOPOPTS, extHeader(IPV6_ROUTING, 0, 8),
+			extHeader(IPV6_DSTOPTS, 0, 8), extHeader(IPPROTO_TCP, 1, 16)),
+			segment, nil},
+		{"first fragment", packet(IPV6_FRAGMENT,
+			fragHeader(IPPROTO_TCP, 0, true)), segment, nil},
+		{"atomic fragment", packet(IPV6_FRAGMENT,
+			fragHeader(IPPROTO_TCP, 0, false)), segment, nil},
+		{"later fragment", packet(IPV6_FRAGMENT,
+			fragHeader(IPPROTO_TCP, 185, false)), nil, ErrFragment},
+		{"ah", packet(IPV6_AH, extHeader(IPPROTO_TCP, 4, 24)), segment, nil},
+		{"hop-by-hop, fragment, ah", packet(IPV6_HOPOPTS,
+			extHeader(IPV6_FRAGMENT, 0, 8), fragHeader(IPV6_AH, 0, true),
+			extHeader(IPPROTO_TCP, 1, 12)), segment, nil},
+		{"esp", packet(IPV6_ESP, extHeader(0, 0, 8)), nil, ErrNotTCP},
+		{"no next header", packet(IPV6_HOPOPTS, extHeader(IPV6_NONEXT, 0, 8)),
+			nil, ErrNotTCP},
+		{"udp", packet(17), nil, ErrNotTCP},
+		{"short header", packet(IPPROTO_TCP)[:39], nil, ErrTruncated},
+		{"short extension", ipv6Packet(clientIPv6, serverIPv6, IPV6_HOPOPTS,
+			extHeader(IPPROTO_TCP, 0, 8)[:4], nil), nil, ErrTruncated},
+		{"extension past the end", ipv6Packet(clientIPv6, serverIPv6,
+			IPV6_HOPOPTS, extHeader(IPPROTO_TCP, 4, 8), nil), nil, ErrTruncated},
+	}
+
+	for _, test := range tests {
+		src, dst, got, err := decodeIP(test.data)
+		if err != test.err {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+		if err == nil && (!src.Equal(clientIPv6) || !dst.Equal(serverIPv6)) {
+			t.Errorf("%s: addresses %s %s", test.name, src, dst)
+		}
+	}
+}
+
+func TestDecodeTCP(t *testing.T) {
+	data := tcpHeader(40000, 8087, 0xdeadbeef, TCP_SYN|TCP_FIN,
+		[]byte{2, 4, 5, 0xb4, 1, 1, 1, 0}, []byte("hello"))
+	seg, err := decodeTCP(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seg.srcPort != 40000 || seg.dstPort != 8087 || seg.seq != 0xdeadbeef ||
+		seg.flags != TCP_SYN|TCP_FIN || string(seg.payload) != "hello" {
+		t.Errorf("decoded %+v", seg)
+	}
+
+	if seg, err = decodeTCP(data[:19]); err != ErrTruncated {
+		t.Errorf("short header: %+v, %v", seg, err)
+	}
+	if seg, err = decodeTCP(data[:27]); err != ErrTruncated {
+		t.Errorf("short options: %+v, %v", seg, err)
+	}
+	bad := append([]byte{}, data...)
+	bad[12] = 4 << 4
+	if seg, err = decodeTCP(bad); err != ErrTruncated {
+		t.Errorf("small offset: %+v, %v", seg, err)
+	}
+}
@@ -0,0 +1,258 @@
+/*
+ * flow.go
+ *
+ * Package flow turns captured frames into TCP connections. Feed it raw frames
+ * (link layer and all) with their timestamps and it works out which client
+ * connection each one belongs to, puts each direction's data back in order,
+ * and hands the bytes to a Handler along with the connection opening and
+ * closing. It doesn't know anything about pcap or what protocol is being
+ * spoken, that's up to whoever is calling it and the Handler respectively.
+ *
+ * Connections are all to one server port, and are identified by the client's
+ * end of them. Everything here is meant to be used from one goroutine, which
+ * includes the Handler calls, so if the Handler wants to do its work somewhere
+ * else it has to hand the data off itself.
+ *
+ */
+
+package flow
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// Direction is which way data is going in a flow.
+type Direction int
+
+const (
+	ToServer Direction = iota // client to server, requests
+	ToClient                  // server to client, responses
+)
+
+// CloseReason is why a flow was closed.
+type CloseReason int
+
+const (
+	Finished CloseReason = iota // both sides sent a FIN, or somebody a RST
+	Reused                      // client opened a new connection from the same port
+	Expired                     // idle for too long, see Tracker.Expire
+	Shutdown                    // Tracker.CloseAll, there won't be more frames
+)
+
+// A Flow is one client connection to the server port.
+type Flow struct {
+	Client   string // "ip:port" or "[ip]:port"
+	ClientIP string
+	Server   string
+	LastSeen time.Time // timestamp of the latest frame
+
+	// For the Handler to keep its own state for the connection in.
+	Context interface{}
+
+	streams [2]tcpStream // indexed by Direction
+	fin     [2]bool
+
+	// To tell a retransmitted SYN from a new connection on the same port.
+	synSeq uint32
+	hasSyn bool
+	used   bool // seen any data, FIN or RST
+}
+
+// A Handler is told about flows as they happen.
+//
+// Data is the in-order payload of one or more segments. If lost is true the
+// tracker had to give up waiting on some missing data, so this doesn't follow
+// on from the last Data for this direction. That includes whatever was still
+// waiting on a gap when the flow closes, which is passed on just before Close.
+// data is often a slice of the frame
+// that was passed to Packet, so if the caller reuses its frame buffers it's only
+// good until Packet returns, and has to be copied to keep it any longer.
+//
+// After Close there won't be any more calls for the flow.
+type Handler interface {
+	Open(f *Flow)
+	Data(f *Flow, dir Direction, ts time.Time, data []byte, lost bool)
+	Close(f *Flow, reason CloseReason)
+}
+
+// A Tracker follows the connections to one server port.
+type Tracker struct {
+	Port uint16
+
+	// How much out of order data to hold on to per direction, waiting for
+	// a missing segment, before giving up on it and skipping ahead.
+	MaxPending int
+
+	// How long to wait for a missing segment, however little is waiting on
+	// it. Packets the capture dropped are never coming, and on a quiet
+	// connection MaxPending could take forever to fill up.
+	MaxPendingAge time.Duration
+
+	handler Handler
+	link    linkDecoder
+	flows   map[string]*Flow
+	now     time.Time // timestamp of the latest frame
+}
+
+// NewTracker returns a Tracker for frames of the given pcap datalink type
+// (one of the DLT_ constants) to and from the given port.
+func NewTracker(dlt int, port uint16, handler Handler) (*Tracker, error) {
+	link, err := getLinkDecoder(dlt)
+	if err != nil {
+		return nil, err
+	}
+	return &Tracker{Port: port, MaxPending: 1 << 20,
+		MaxPendingAge: 5 * time.Second, handler: handler, link: link,
+		flows: make(map[string]*Flow)}, nil
+}
+
+// Len returns the number of open flows.
+func (t *Tracker) Len() int {
+	return len(t.flows)
+}
+
+// Packet processes one frame captured at the given time. Frames that aren't
+// TCP to or from our port are skipped and the reason is returned, none of
+// which are fatal.
+//
+// The tracker doesn't hold on to frame once Packet returns, so the caller is
+// free to reuse it for the next one, as long as the Handler isn't keeping it
+// either.
+func (t *Tracker) Packet(ts time.Time, frame []byte) error {
+	if ts.After(t.now) {
+		t.now = ts
+	}
+
+	// Get rid of whatever link layer this is.
+	data, err := t.link(frame)
+	if err != nil {
+		return err
+	}
+
+	// Grab the addresses from the IP header, either v4 or v6, and then the
+	// ports from the TCP header.
+	srcIP, dstIP, segment, err := decodeIP(data)
+	if err != nil {
+		return err
+	}
+	tcp, err := decodeTCP(segment)
+	if err != nil {
+		return err
+	}
+
+	// This is either an inbound or outbound packet. Determine by seeing which
+	// end contains our port. Either way, the flow is named for the client end.
+	srcAddr := net.JoinHostPort(srcIP.String(), strconv.Itoa(int(tcp.srcPort)))
+	dstAddr := net.JoinHostPort(dstIP.String(), strconv.Itoa(int(tcp.dstPort)))
+	var client, server string
+	var dir Direction
+	if tcp.dstPort == t.Port {
+		client, server, dir = srcAddr, dstAddr, ToServer
+	} else if tcp.srcPort == t.Port {
+		client, server, dir = dstAddr, srcAddr, ToClient
+	} else {
+		return ErrOtherPort
+	}
+
+	// A client opening a connection from a port we think is already in use
+	// means we missed the end of the old one. Unless it's the same SYN again
+	// because the SYN-ACK went missing, in which case nothing has happened
+	// on the connection yet.
+	syn := tcp.flags&TCP_SYN != 0
+	f, ok := t.flows[client]
+	if ok && syn && dir == ToServer &&
+		(f.used || f.hasSyn && f.synSeq != tcp.seq) {
+		t.close(f, Reused)
+		ok = false
+	}
+
+	// Don't bother setting anything up for empty packets that aren't the start
+	// of a connection. These are the ACKs and FINs trailing one we've already
+	// closed, or ones we never saw any of.
+	if !ok {
+		if !syn && len(tcp.payload) == 0 {
+			return nil
+		}
+		clientIP, _, _ := net.SplitHostPort(client)
+		f = &Flow{Client: client, ClientIP: clientIP, Server: server,
+			LastSeen: ts}
+		t.flows[client] = f
+		t.handler.Open(f)
+	}
+	f.LastSeen = ts
+	if syn && dir == ToServer {
+		f.synSeq, f.hasSyn = tcp.seq, true
+	}
+	if len(tcp.payload) > 0 || tcp.flags&(TCP_FIN|TCP_RST) != 0 {
+		f.used = true
+	}
+
+	// Put the segment in order with the rest of this direction of the
+	// connection. We may not get anything back if it's out of order.
+	t.skipStale(f)
+	payload, lost := f.streams[dir].add(tcp, ts, t.MaxPending)
+	if len(payload) > 0 {
+		t.handler.Data(f, dir, ts, payload, lost)
+	}
+
+	// A reset ends things right away, otherwise we wait for both sides to
+	// say they're finished.
+	if tcp.flags&TCP_RST != 0 {
+		f.fin[ToServer], f.fin[ToClient] = true, true
+	} else if tcp.flags&TCP_FIN != 0 {
+		f.fin[dir] = true
+	}
+	if f.fin[ToServer] && f.fin[ToClient] {
+		t.close(f, Finished)
+	}
+	return nil
+}
+
+// Expire closes every flow we haven't seen a frame on since the given time.
+// These are ones where we missed the FIN or RST, or the client is just holding
+// it open and not doing anything. It also gives up on any gaps in the rest
+// that have been waiting for longer than MaxPendingAge.
+func (t *Tracker) Expire(before time.Time) {
+	for _, f := range t.flows {
+		if f.LastSeen.Before(before) {
+			t.close(f, Expired)
+		} else {
+			t.skipStale(f)
+		}
+	}
+}
+
+// CloseAll closes every flow, for when there are no more frames coming.
+func (t *Tracker) CloseAll() {
+	for _, f := range t.flows {
+		t.close(f, Shutdown)
+	}
+}
+
+// skipStale skips over the gap in either direction of a flow if we've been
+// waiting on it for too long, by the clock of the frames we've been given.
+func (t *Tracker) skipStale(f *Flow) {
+	for dir := range f.streams {
+		since := f.streams[dir].waitingSince()
+		if since.IsZero() || t.now.Sub(since) <= t.MaxPendingAge {
+			continue
+		}
+		if data := f.streams[dir].skip(); len(data) > 0 {
+			t.handler.Data(f, Direction(dir), t.now, data, true)
+		}
+	}
+}
+
+func (t *Tracker) close(f *Flow, reason CloseReason) {
+	// Anything still waiting on a gap isn't going to get it now.
+	for dir := range f.streams {
+		if data := f.streams[dir].skip(); len(data) > 0 {
+			t.handler.Data(f, Direction(dir), f.LastSeen, data, true)
+		}
+	}
+
+	delete(t.flows, f.Client)
+	t.handler.Close(f, reason)
+}
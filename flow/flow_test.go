@@ -0,0 +1,406 @@
+package flow
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+var reasonNames = map[CloseReason]string{
+	Finished: "finished",
+	Reused:   "reused",
+	Expired:  "expired",
+	Shutdown: "shutdown",
+}
+
+// A recorder is a Handler that writes down everything it's told.
+type recorder struct {
+	events []string
+}
+
+func (r *recorder) Open(f *Flow) {
+	r.events = append(r.events, "open "+f.Client)
+}
+
+func (r *recorder) Data(f *Flow, dir Direction, ts time.Time, data []byte,
+	lost bool) {
+	event := fmt.Sprintf("%s %s %q at %d", f.Client,
+		map[Direction]string{ToServer: "->", ToClient: "<-"}[dir], data,
+		ts.Unix())
+	if lost {
+		event += " lost"
+	}
+	r.events = append(r.events, event)
+}
+
+func (r *recorder) Close(f *Flow, reason CloseReason) {
+	r.events = append(r.events, "close "+f.Client+" "+reasonNames[reason])
+}
+
+// take returns the events so far and forgets them.
+func (r *recorder) take() string {
+	events := strings.Join(r.events, "\n")
+	r.events = nil
+	return events
+}
+
+// packet builds a raw IPv4 frame between port on 10.0.0.1 and 8087 on
+// 10.0.0.2.
+func packet(port uint16, dir Direction, seq uint32, flags byte,
+	payload string) []byte {
+	if dir == ToClient {
+		return ipv4Packet(serverIPv4, clientIPv4, nil, IPPROTO_TCP,
+			tcpHeader(8087, port, seq, flags, nil, []byte(payload)))
+	}
+	return ipv4Packet(clientIPv4, serverIPv4, nil, IPPROTO_TCP,
+		tcpHeader(port, 8087, seq, flags, nil, []byte(payload)))
+}
+
+func newTestTracker(t *testing.T) (*Tracker, *recorder) {
+	r := &recorder{}
+	tracker, err := NewTracker(DLT_RAW, 8087, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tracker, r
+}
+
+// feed gives the tracker frames, all of which should be taken.
+func feed(t *testing.T, tracker *Tracker, sec int64, frames ...[]byte) {
+	for _, frame := range frames {
+		if err := tracker.Packet(time.Unix(sec, 0), frame); err != nil {
+			t.Fatalf("frame at %d: %s", sec, err)
+		}
+	}
+}
+
+func checkEvents(t *testing.T, r *recorder, want ...string) {
+	if got := r.take(); got != strings.Join(want, "\n") {
+		t.Errorf("got events:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
+
+func TestTrackerFinished(t *testing.T) {
+	tracker, r := newTestTracker(t)
+	feed(t, tracker, 1, packet(40000, ToServer, 100, TCP_SYN, ""),
+		packet(40000, ToClient, 900, TCP_SYN, ""),
+		packet(40000, ToServer, 101, 0, ""))
+	checkEvents(t, r, "open 10.0.0.1:40000")
+
+	feed(t, tracker, 2, packet(40000, ToServer, 101, 0, "ping"))
+	feed(t, tracker, 3, packet(40000, ToClient, 901, 0, "pong"))
+	feed(t, tracker, 4, packet(40000, ToServer, 105, TCP_FIN, ""))
+	checkEvents(t, r,
+		`10.0.0.1:40000 -> "ping" at 2`,
+		`10.0.0.1:40000 <- "pong" at 3`)
+	if tracker.Len() != 1 {
+		t.Errorf("tracking %d flows after one FIN", tracker.Len())
+	}
+
+	// The last data comes with the server's FIN, and is passed on before the
+	// flow is closed.
+	feed(t, tracker, 5, packet(40000, ToClient, 905, TCP_FIN, "bye"))
+	checkEvents(t, r,
+		`10.0.0.1:40000 <- "bye" at 5`,
+		"close 10.0.0.1:40000 finished")
+	if tracker.Len() != 0 {
+		t.Errorf("tracking %d flows after both FINs", tracker.Len())
+	}
+
+	// The final ACK doesn't bring it back.
+	feed(t, tracker, 6, packet(40000, ToServer, 106, 0, ""))
+	checkEvents(t, r)
+	if tracker.Len() != 0 {
+		t.Errorf("tracking %d flows after the last ACK", tracker.Len())
+	}
+}
+
+func TestTrackerReset(t *testing.T) {
+	for _, dir := range []Direction{ToServer, ToClient} {
+		tracker, r := newTestTracker(t)
+		feed(t, tracker, 1, packet(40000, ToServer, 100, TCP_SYN, ""),
+			packet(40000, ToServer, 101, 0, "ping"))
+		feed(t, tracker, 2, packet(40000, dir, 105, TCP_RST, ""))
+		checkEvents(t, r, "open 10.0.0.1:40000",
+			`10.0.0.1:40000 -> "ping" at 1`,
+			"close 10.0.0.1:40000 finished")
+		if tracker.Len() != 0 {
+			t.Errorf("tracking %d flows after a RST", tracker.Len())
+		}
+	}
+}
+
+func TestTrackerReused(t *testing.T) {
+	tracker, r := newTestTracker(t)
+	feed(t, tracker, 1, packet(40000, ToServer, 100, TCP_SYN, ""),
+		packet(40000, ToServer, 101, 0, "one"))
+
+	// We never saw the end of that one, and the port comes around again.
+	feed(t, tracker, 2, packet(40000, ToServer, 5000, TCP_SYN, ""),
+		packet(40000, ToServer, 5001, 0, "two"))
+	checkEvents(t, r, "open 10.0.0.1:40000",
+		`10.0.0.1:40000 -> "one" at 1`,
+		"close 10.0.0.1:40000 reused",
+		"open 10.0.0.1:40000",
+		`10.0.0.1:40000 -> "two" at 2`)
+
+	// A SYN from the server isn't the client reusing the port.
+	feed(t, tracker, 3, packet(40000, ToClient, 7000, TCP_SYN, ""))
+	checkEvents(t, r)
+
+	// Nor is the SYN coming again because the SYN-ACK went missing.
+	feed(t, tracker, 4, packet(40001, ToServer, 100, TCP_SYN, ""))
+	feed(t, tracker, 5, packet(40001, ToServer, 100, TCP_SYN, ""))
+	feed(t, tracker, 6, packet(40001, ToServer, 101, 0, "three"))
+	checkEvents(t, r, "open 10.0.0.1:40001",
+		`10.0.0.1:40001 -> "three" at 6`)
+
+	// But a different SYN is, even if nothing happened on the first one.
+	feed(t, tracker, 7, packet(40002, ToServer, 100, TCP_SYN, ""))
+	feed(t, tracker, 8, packet(40002, ToServer, 200, TCP_SYN, ""))
+	checkEvents(t, r, "open 10.0.0.1:40002",
+		"close 10.0.0.1:40002 reused",
+		"open 10.0.0.1:40002")
+	if tracker.Len() != 3 {
+		t.Errorf("tracking %d flows, want 3", tracker.Len())
+	}
+}
+
+func TestTrackerExpire(t *testing.T) {
+	tracker, r := newTestTracker(t)
+
+	// Picked up in the middle, without a SYN.
+	feed(t, tracker, 10, packet(40000, ToServer, 100, 0, "a"))
+	feed(t, tracker, 20, packet(40001, ToServer, 100, 0, "b"))
+	feed(t, tracker, 30, packet(40002, ToServer, 100, 0, "c"))
+	feed(t, tracker, 40, packet(40000, ToClient, 100, 0, "d"))
+	r.take()
+
+	tracker.Expire(time.Unix(25, 0))
+	checkEvents(t, r, "close 10.0.0.1:40001 expired")
+	tracker.Expire(time.Unix(25, 0))
+	checkEvents(t, r)
+	if tracker.Len() != 2 {
+		t.Errorf("tracking %d flows after expiring, want 2", tracker.Len())
+	}
+
+	// Expired flows start afresh if they turn up again.
+	feed(t, tracker, 50, packet(40001, ToServer, 101, 0, "e"))
+	checkEvents(t, r, "open 10.0.0.1:40001", `10.0.0.1:40001 -> "e" at 50`)
+
+	tracker.CloseAll()
+	events := strings.Split(r.take(), "\n")
+	if len(events) != 3 {
+		t.Fatalf("CloseAll gave %v", events)
+	}
+	for _, event := range events {
+		if !strings.HasSuffix(event, " shutdown") {
+			t.Errorf("CloseAll gave %q", event)
+		}
+	}
+	if tracker.Len() != 0 {
+		t.Errorf("tracking %d flows after CloseAll", tracker.Len())
+	}
+}
+
+// Out of order data is held back and then comes out in order, and a gap that
+// doesn't get filled is skipped over eventually.
+func TestTrackerReordering(t *testing.T) {
+	tracker, r := newTestTracker(t)
+	tracker.MaxPending = 6
+	feed(t, tracker, 1, packet(40000, ToServer, 100, TCP_SYN, ""))
+	feed(t, tracker, 2, packet(40000, ToServer, 104, 0, "def"))
+	feed(t, tracker, 3, packet(40000, ToServer, 101, 0, "abc"))
+	feed(t, tracker, 4, packet(40000, ToServer, 110, 0, "jkl"))
+	feed(t, tracker, 5, packet(40000, ToServer, 113, 0, "mno"))
+	checkEvents(t, r, "open 10.0.0.1:40000",
+		`10.0.0.1:40000 -> "abcdef" at 3`)
+	feed(t, tracker, 6, packet(40000, ToServer, 116, 0, "p"))
+	checkEvents(t, r, `10.0.0.1:40000 -> "jklmnop" at 6 lost`)
+}
+
+// The tracker doesn't keep hold of frames, so the caller can reuse its buffer.
+func TestTrackerFrameReuse(t *testing.T) {
+	tracker, r := newTestTracker(t)
+	buf := make([]byte, 0, 1500)
+	reuse := func(frame []byte) []byte {
+		return append(buf[:0], frame...)
+	}
+	feed(t, tracker, 1, reuse(packet(40000, ToServer, 100, TCP_SYN, "")))
+	feed(t, tracker, 2, reuse(packet(40000, ToServer, 104, 0, "def")))
+	feed(t, tracker, 3, reuse(packet(40000, ToServer, 107, 0, "ghi")))
+	r.take()
+
+	feed(t, tracker, 4, reuse(packet(40000, ToServer, 101, 0, "abc")))
+	checkEvents(t, r, `10.0.0.1:40000 -> "abcdefghi" at 4`)
+}
+
+func TestTrackerIPv6(t *testing.T) {
+	r := &recorder{}
+	tracker, err := NewTracker(DLT_IPV6, 8087, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	feed(t, tracker, 1, ipv6Packet(clientIPv6, serverIPv6, IPV6_HOPOPTS,
+		extHeader(IPPROTO_TCP, 0, 8),
+		tcpHeader(40000, 8087, 100, 0, nil, []byte("hi"))))
+	checkEvents(t, r, "open [2001:db8::1]:40000",
+		`[2001:db8::1]:40000 -> "hi" at 1`)
+	f := tracker.flows["[2001:db8::1]:40000"]
+	if f == nil || f.ClientIP != "2001:db8::1" ||
+		f.Server != "[2001:db8::2]:8087" {
+		t.Errorf("flow is %+v", f)
+	}
+}
+
+// Frames we can't use are skipped without bothering the handler.
+func TestTrackerSkipped(t *testing.T) {
+	tracker, r := newTestTracker(t)
+	segment := tcpHeader(40000, 8087, 100, TCP_SYN, nil, nil)
+
+	tests := []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"other port", ipv4Packet(clientIPv4, serverIPv4, nil, IPPROTO_TCP,
+			tcpHeader(40000, 80, 100, TCP_SYN, nil, nil)), ErrOtherPort},
+		{"udp", ipv4Packet(clientIPv4, serverIPv4, nil, 17, segment), ErrNotTCP},
+		{"short ip", ipv4Packet(clientIPv4, serverIPv4, nil, IPPROTO_TCP,
+			segment)[:10], ErrTruncated},
+		{"short tcp", ipv4Packet(clientIPv4, serverIPv4, nil, IPPROTO_TCP,
+			segment[:12]), ErrTruncated},
+		{"fragment", ipv6Packet(clientIPv6, serverIPv6, IPV6_FRAGMENT,
+			fragHeader(IPPROTO_TCP, 3, false), segment), ErrFragment},
+	}
+	for _, test := range tests {
+		if err := tracker.Packet(time.Unix(1, 0), test.frame); err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+	checkEvents(t, r)
+	if tracker.Len() != 0 {
+		t.Errorf("tracking %d flows", tracker.Len())
+	}
+
+	// Nor do empty segments on connections we haven't seen.
+	feed(t, tracker, 1, packet(40000, ToServer, 100, 0, ""),
+		packet(40000, ToClient, 100, TCP_FIN, ""),
+		packet(40000, ToServer, 100, TCP_RST, ""))
+	checkEvents(t, r)
+	if tracker.Len() != 0 {
+		t.Errorf("tracking %d flows", tracker.Len())
+	}
+}
+
+// A counter is a Handler that just adds up the data it's given.
+type counter struct {
+	bytes, lost int
+}
+
+func (c *counter) Open(f *Flow) {}
+
+func (c *counter) Data(f *Flow, dir Direction, ts time.Time, data []byte,
+	lost bool) {
+	c.bytes += len(data)
+	if lost {
+		c.lost++
+	}
+}
+
+func (c *counter) Close(f *Flow, reason CloseReason) {}
+
+// A segment the capture dropped on a quiet connection is given up on after
+// MaxPendingAge, rather than hiding everything after it for as long as the
+// connection lasts.
+func TestTrackerGapAge(t *testing.T) {
+	c := &counter{}
+	tracker, err := NewTracker(DLT_RAW, 8087, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed(t, tracker, 0, packet(40000, ToServer, 100, TCP_SYN, ""),
+		packet(40000, ToServer, 101, 0, "a"))
+
+	// 10 bytes go missing, then a segment a second for an hour.
+	seq := uint32(112)
+	for sec := int64(1); sec <= 3600; sec++ {
+		feed(t, tracker, sec, packet(40000, ToServer, seq, 0, "0123456789"))
+		seq += 10
+
+		// Nothing until we've waited long enough.
+		if sec == 6 && c.bytes != 1 {
+			t.Errorf("%d bytes after %d seconds", c.bytes, sec)
+		}
+	}
+	if c.bytes != 36001 || c.lost != 1 {
+		t.Errorf("got %d bytes, %d lost, want 36001 and 1", c.bytes, c.lost)
+	}
+}
+
+// Expire gives up on old gaps too, for flows that have gone quiet but aren't
+// idle enough to be closed.
+func TestTrackerExpireGap(t *testing.T) {
+	tracker, r := newTestTracker(t)
+	feed(t, tracker, 0, packet(40000, ToServer, 100, TCP_SYN, ""))
+	feed(t, tracker, 1, packet(40000, ToServer, 105, 0, "later"))
+	feed(t, tracker, 4, packet(40001, ToServer, 100, 0, "other"))
+	r.take()
+
+	tracker.Expire(time.Unix(0, 0))
+	checkEvents(t, r)
+
+	feed(t, tracker, 10, packet(40001, ToServer, 105, 0, "more"))
+	r.take()
+	tracker.Expire(time.Unix(0, 0))
+	checkEvents(t, r, `10.0.0.1:40000 -> "later" at 10 lost`)
+	if tracker.Len() != 2 {
+		t.Errorf("tracking %d flows, want 2", tracker.Len())
+	}
+}
+
+// Whatever is still waiting on a gap when a flow closes is passed on first,
+// however it closes.
+func TestTrackerCloseFlushes(t *testing.T) {
+	tests := []struct {
+		name   string
+		end    func(tracker *Tracker)
+		reason string
+		at     int // timestamp the leftover data is passed on with
+	}{
+		{"finished", func(tracker *Tracker) {
+			feed(t, tracker, 3, packet(40000, ToServer, 200, TCP_FIN, ""),
+				packet(40000, ToClient, 900, TCP_FIN, ""))
+		}, "finished", 3},
+		{"reset", func(tracker *Tracker) {
+			feed(t, tracker, 3, packet(40000, ToClient, 900, TCP_RST, ""))
+		}, "finished", 3},
+		{"reused", func(tracker *Tracker) {
+			feed(t, tracker, 3, packet(40000, ToServer, 5000, TCP_SYN, ""))
+		}, "reused", 2},
+		{"expired", func(tracker *Tracker) {
+			tracker.Expire(time.Unix(3, 0))
+		}, "expired", 2},
+		{"shutdown", func(tracker *Tracker) {
+			tracker.CloseAll()
+		}, "shutdown", 2},
+	}
+
+	for _, test := range tests {
+		tracker, r := newTestTracker(t)
+		feed(t, tracker, 1, packet(40000, ToServer, 100, TCP_SYN, ""),
+			packet(40000, ToServer, 101, 0, "ab"))
+		feed(t, tracker, 2, packet(40000, ToServer, 110, 0, "xyz"))
+		r.take()
+
+		test.end(tracker)
+		events := strings.Split(r.take(), "\n")
+		if len(events) < 2 ||
+			events[0] != fmt.Sprintf(`10.0.0.1:40000 -> "xyz" at %d lost`, test.at) ||
+			events[1] != "close 10.0.0.1:40000 "+test.reason {
+			t.Errorf("%s: got %q", test.name, events)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * reassembly.go
+ *
+ * Puts TCP segments back in sequence order so that the protocol handler sees
+ * the same byte stream the two ends of the connection did. Duplicates are
+ * dropped and out of order segments are held until the gap before them is
+ * filled, or until we've buffered too much or waited too long and have to give
+ * up on it.
+ *
+ */
+
+package flow
+
+import (
+	"time"
+)
+
+// A tcpChunk is a piece of payload waiting for the data before it to show up.
+type tcpChunk struct {
+	seq  uint32
+	data []byte
+	ts   time.Time // when it arrived
+}
+
+// A tcpStream is one direction of a TCP connection.
+type tcpStream struct {
+	started      bool
+	next         uint32      // sequence number of the next byte we expect
+	pending      []*tcpChunk // out of order data, sorted by sequence number
+	pendingBytes int
+}
+
+// seqDiff returns a - b, accounting for the sequence numbers wrapping.
+func seqDiff(a, b uint32) int {
+	return int(int32(a - b))
+}
+
+// add takes a segment that arrived at the given time and returns whatever
+// in-order data it made available, which may be nothing if it was a duplicate
+// or came in ahead of a gap. If we had to skip over missing data to get here,
+// lost is true and the returned data does not follow on from what was
+// previously returned.
+func (ts *tcpStream) add(seg *tcpSegment, at time.Time,
+	maxPending int) (data []byte, lost bool) {
+	seq, payload := seg.seq, seg.payload
+
+	// A SYN tells us exactly where the stream starts, and it takes up one
+	// sequence number itself.
+	if seg.flags&TCP_SYN != 0 {
+		seq++
+		ts.started, ts.next = true, seq
+		ts.pending, ts.pendingBytes = nil, 0
+	}
+	if len(payload) == 0 {
+		return nil, false
+	}
+
+	// Otherwise we picked this connection up in the middle and the best we
+	// can do is start from the first data we see.
+	if !ts.started {
+		ts.started, ts.next = true, seq
+	}
+
+	diff := seqDiff(seq, ts.next)
+	if diff < 0 {
+		// Retransmission of something we've already passed on. It might have
+		// some new data tacked onto the end though.
+		if -diff >= len(payload) {
+			return nil, false
+		}
+		payload, seq, diff = payload[-diff:], ts.next, 0
+	}
+
+	if diff > 0 {
+		ts.insert(seq, payload, at)
+		if ts.pendingBytes <= maxPending {
+			return nil, false
+		}
+
+		// We've waited long enough, the missing data isn't coming.
+		return ts.skip(), true
+	}
+
+	ts.next += uint32(len(payload))
+	return ts.drain(payload), false
+}
+
+// skip gives up on the missing data in front of whatever is pending, and
+// returns everything that's in order from there on.
+func (ts *tcpStream) skip() []byte {
+	if len(ts.pending) == 0 {
+		return nil
+	}
+	ts.next = ts.pending[0].seq
+	return ts.drain(nil)
+}
+
+// drain adds any pending data that now follows on from data.
+func (ts *tcpStream) drain(data []byte) []byte {
+	for len(ts.pending) > 0 {
+		chunk := ts.pending[0]
+		diff := seqDiff(chunk.seq, ts.next)
+		if diff > 0 {
+			break
+		}
+
+		ts.pending = ts.pending[1:]
+		ts.pendingBytes -= len(chunk.data)
+		if -diff >= len(chunk.data) {
+			continue
+		}
+
+		// Force a copy the first time so we don't scribble over whatever is
+		// after the payload in the packet buffer.
+		data = append(data[:len(data):len(data)], chunk.data[-diff:]...)
+		ts.next += uint32(len(chunk.data) + diff)
+	}
+	if len(ts.pending) == 0 {
+		ts.pending = nil
+	}
+	return data
+}
+
+// waitingSince returns when the oldest pending data arrived, which is how long
+// we've been waiting on a gap. It's the zero time if nothing is pending.
+func (ts *tcpStream) waitingSince() time.Time {
+	var oldest time.Time
+	for _, chunk := range ts.pending {
+		if oldest.IsZero() || chunk.ts.Before(oldest) {
+			oldest = chunk.ts
+		}
+	}
+	return oldest
+}
+
+// insert saves some out of order data in the pending list. If there's already
+// data at this sequence number, we keep whichever is longer.
+//
+// data is part of the caller's frame, which may well be a capture buffer that
+// gets reused for the next packet, so we keep our own copy.
+func (ts *tcpStream) insert(seq uint32, data []byte, at time.Time) {
+	i := 0
+	for ; i < len(ts.pending); i++ {
+		diff := seqDiff(seq, ts.pending[i].seq)
+		if diff == 0 {
+			if len(data) > len(ts.pending[i].data) {
+				ts.pendingBytes += len(data) - len(ts.pending[i].data)
+				ts.pending[i].data = append([]byte(nil), data...)
+			}
+			return
+		}
+		if diff < 0 {
+			break
+		}
+	}
+
+	ts.pending = append(ts.pending, nil)
+	copy(ts.pending[i+1:], ts.pending[i:])
+	ts.pending[i] = &tcpChunk{seq: seq, data: append([]byte(nil), data...),
+		ts: at}
+	ts.pendingBytes += len(data)
+}
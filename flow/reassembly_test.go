@@ -0,0 +1,205 @@
+package flow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTcpStreamAdd(t *testing.T) {
+	type step struct {
+		seq   uint32
+		flags byte
+		data  string
+		want  string // in-order data that comes out
+		lost  bool
+	}
+	tests := []struct {
+		name       string
+		maxPending int
+		steps      []step
+	}{
+		{"in order", 100, []step{
+			{100, TCP_SYN, "", "", false},
+			{101, 0, "abc", "abc", false},
+			{104, 0, "de", "de", false},
+		}},
+		{"picked up midstream", 100, []step{
+			{5000, 0, "abc", "abc", false},
+			{5003, 0, "de", "de", false},
+		}},
+		{"reordered", 100, []step{
+			{0, TCP_SYN, "", "", false},
+			{4, 0, "def", "", false},
+			{1, 0, "abc", "abcdef", false},
+		}},
+		{"reversed", 100, []step{
+			{0, TCP_SYN, "", "", false},
+			{7, 0, "gh", "", false},
+			{4, 0, "def", "", false},
+			{1, 0, "abc", "abcdefgh", false},
+		}},
+		{"partly filled gap", 100, []step{
+			{0, TCP_SYN, "", "", false},
+			{7, 0, "gh", "", false},
+			{1, 0, "abc", "abc", false},
+			{4, 0, "def", "defgh", false},
+		}},
+		{"duplicate", 100, []step{
+			{0, TCP_SYN, "", "", false},
+			{1, 0, "abc", "abc", false},
+			{1, 0, "abc", "", false},
+			{4, 0, "de", "de", false},
+		}},
+		{"duplicate pending", 100, []step{
+			{0, TCP_SYN, "", "", false},
+			{4, 0, "def", "", false},
+			{4, 0, "def", "", false},
+			{1, 0, "abc", "abcdef", false},
+		}},
+		{"longer retransmit of pending", 100, []step{
+			{0, TCP_SYN, "", "", false},
+			{4, 0, "d", "", false},
+			{4, 0, "def", "", false},
+			{4, 0, "de", "", false},
+			{1, 0, "abc", "abcdef", false},
+		}},
+		{"overlapping retransmit", 100, []step{
+			{0, TCP_SYN, "", "", false},
+			{1, 0, "abc", "abc", false},
+			{2, 0, "bcdef", "def", false},
+			{7, 0, "g", "g", false},
+		}},
+		{"overlapping pending", 100, []step{
+			{0, TCP_SYN, "", "", false},
+			{4, 0, "defg", "", false},
+			{6, 0, "fgh", "", false},
+			{1, 0, "abc", "abcdefgh", false},
+		}},
+		{"pending already covered", 100, []step{
+			{0, TCP_SYN, "", "", false},
+			{2, 0, "b", "", false},
+			{1, 0, "abcd", "abcd", false},
+			{5, 0, "e", "e", false},
+		}},
+		{"gap given up on", 4, []step{
+			{0, TCP_SYN, "", "", false},
+			{1, 0, "ab", "ab", false},
+			{10, 0, "xyz", "", false},
+			{13, 0, "uv", "xyzuv", true},
+			{15, 0, "w", "w", false},
+			{3, 0, "cdefghi", "", false},
+		}},
+		{"gap given up on, more pending", 4, []step{
+			{0, TCP_SYN, "", "", false},
+			{20, 0, "uv", "", false},
+			{10, 0, "xyz", "xyz", true},
+			{13, 0, "abcdefg", "abcdefguv", false},
+		}},
+		{"wraparound", 100, []step{
+			{0xfffffffd, TCP_SYN, "", "", false},
+			{0xfffffffe, 0, "ab", "ab", false},
+			{0, 0, "cd", "cd", false},
+			{0xffffffff, 0, "bc", "", false},
+		}},
+		{"reordered across the wrap", 100, []step{
+			{0xfffffffd, TCP_SYN, "", "", false},
+			{0, 0, "cd", "", false},
+			{0xfffffffe, 0, "ab", "abcd", false},
+			{2, 0, "e", "e", false},
+		}},
+		{"syn starts over", 100, []step{
+			{0, TCP_SYN, "", "", false},
+			{4, 0, "def", "", false},
+			{1000, TCP_SYN, "", "", false},
+			{1001, 0, "abc", "abc", false},
+		}},
+	}
+
+	for _, test := range tests {
+		var ts tcpStream
+		for i, s := range test.steps {
+			seg := &tcpSegment{seq: s.seq, flags: s.flags,
+				payload: []byte(s.data)}
+			data, lost := ts.add(seg, time.Unix(int64(i), 0), test.maxPending)
+			if string(data) != s.want || lost != s.lost {
+				t.Errorf("%s: step %d got %q, %v, want %q, %v", test.name, i,
+					data, lost, s.want, s.lost)
+			}
+
+			pending := 0
+			for j, chunk := range ts.pending {
+				pending += len(chunk.data)
+				if j > 0 && seqDiff(chunk.seq, ts.pending[j-1].seq) <= 0 {
+					t.Errorf("%s: step %d pending out of order", test.name, i)
+				}
+			}
+			if pending != ts.pendingBytes {
+				t.Errorf("%s: step %d pendingBytes is %d, want %d", test.name, i,
+					ts.pendingBytes, pending)
+			}
+		}
+	}
+}
+
+// Pending data is copied, as the frame it came in is likely to be reused, and
+// stitching it onto the end of in-order data doesn't scribble past that data.
+func TestTcpStreamCopies(t *testing.T) {
+	var ts tcpStream
+	at := time.Unix(1, 0)
+	ts.add(&tcpSegment{seq: 0, flags: TCP_SYN}, at, 100)
+
+	frame := []byte("def")
+	ts.add(&tcpSegment{seq: 4, payload: frame}, at, 100)
+	copy(frame, "XXX")
+
+	frame = []byte("abc-trailer")
+	data, _ := ts.add(&tcpSegment{seq: 1, payload: frame[:3]}, at, 100)
+	if string(data) != "abcdef" {
+		t.Errorf("got %q", data)
+	}
+	if string(frame) != "abc-trailer" {
+		t.Errorf("frame was scribbled on: %q", frame)
+	}
+}
+
+// Giving up on a gap passes on everything after it, up to the next gap, and
+// the wait is timed from the oldest data still pending.
+func TestTcpStreamSkip(t *testing.T) {
+	var ts tcpStream
+	if data := ts.skip(); data != nil {
+		t.Errorf("skipped to %q with nothing pending", data)
+	}
+	if since := ts.waitingSince(); !since.IsZero() {
+		t.Errorf("waiting since %s with nothing pending", since)
+	}
+
+	ts.add(&tcpSegment{seq: 0, flags: TCP_SYN}, time.Unix(1, 0), 100)
+	ts.add(&tcpSegment{seq: 1, payload: []byte("ab")}, time.Unix(1, 0), 100)
+	ts.add(&tcpSegment{seq: 20, payload: []byte("xy")}, time.Unix(2, 0), 100)
+	ts.add(&tcpSegment{seq: 10, payload: []byte("jk")}, time.Unix(3, 0), 100)
+	ts.add(&tcpSegment{seq: 12, payload: []byte("lm")}, time.Unix(4, 0), 100)
+	if since := ts.waitingSince(); !since.Equal(time.Unix(2, 0)) {
+		t.Errorf("waiting since %s", since)
+	}
+
+	if data := ts.skip(); string(data) != "jklm" {
+		t.Errorf("first skip got %q", data)
+	}
+	if since := ts.waitingSince(); !since.Equal(time.Unix(2, 0)) {
+		t.Errorf("waiting since %s after skipping", since)
+	}
+	if data := ts.skip(); string(data) != "xy" {
+		t.Errorf("second skip got %q", data)
+	}
+	if ts.pending != nil || ts.pendingBytes != 0 || ts.next != 22 {
+		t.Errorf("after skipping: %d pending, %d bytes, next %d",
+			len(ts.pending), ts.pendingBytes, ts.next)
+	}
+
+	// And things carry on from there.
+	data, lost := ts.add(&tcpSegment{seq: 22, payload: []byte("z")},
+		time.Unix(5, 0), 100)
+	if string(data) != "z" || lost {
+		t.Errorf("after skipping got %q, %v", data, lost)
+	}
+}
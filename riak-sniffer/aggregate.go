@@ -0,0 +1,143 @@
+/*
+ * aggregate.go
+ *
+ * All of the aggregated numbers (qbuf, querycount, the global timings and
+ * windows) belong to a single goroutine. The listeners send it events as
+ * requests are counted and completed, and anything that wants to look at the
+ * numbers, like a status update, has the aggregator run it. That way none of
+ * it needs locking, and nothing ever sees a half updated queryData.
+ *
+ */
+
+package main
+
+import (
+	"time"
+)
+
+// A request was sent, to be counted under text.
+type requestEvent struct {
+	text   string
+	values map[int]string // of each F_XXXXXX token, only for the UI
+	gen    int            // formatGen when the text was made
+	bytes  uint64
+	ts     time.Time
+}
+
+// A request got the last frame of its response.
+type responseEvent struct {
+	text      string
+	gen       int // -1 if the request wasn't counted
+	bytes     uint64
+	reqtime   uint64 // nanoseconds
+	firsttime uint64
+	streamed  bool
+	outcome   string
+	ts        time.Time
+}
+
+// A connection got synchronized, after this many nanoseconds.
+type syncEvent struct {
+	synctime uint64
+}
+
+// What time it is by the packets, sent every status period by the capture
+// loop. If status is set, it's time for a status update too.
+type tickEvent struct {
+	start        time.Time
+	now          time.Time
+	status       bool
+	displaycount int
+}
+
+// Events are any of the above, or a func() to run.
+var aggch = make(chan interface{}, 10000)
+
+// The aggregator's idea of when we started and what time it is, as of the
+// last tickEvent.
+var aggStart, aggNow time.Time
+
+// The formatGen that qbuf was made with. Events from before the format last
+// changed still count towards the totals, but not towards qbuf.
+var aggGen int
+
+func startAggregator() {
+	go aggregator()
+}
+
+func aggregator() {
+	for ev := range aggch {
+		switch ev := ev.(type) {
+		case requestEvent:
+			countQuery(&ev)
+		case responseEvent:
+			countResponse(&ev)
+		case syncEvent:
+			synctimes.record(ev.synctime)
+		case tickEvent:
+			aggStart, aggNow = ev.start, ev.now
+			if ev.status {
+				handleStatusUpdate(ev.displaycount)
+			}
+		case func():
+			ev()
+		}
+	}
+}
+
+// aggregate has the aggregator run a function, and waits for it to be done.
+func aggregate(fn func()) {
+	done := make(chan bool)
+	aggch <- func() {
+		fn()
+		close(done)
+	}
+	<-done
+}
+
+// countQuery records a request against its aggregation key.
+func countQuery(ev *requestEvent) {
+	querycount++
+	ws := windowSlot{count: 1, bytes: ev.bytes}
+	recent.add(ev.ts.Unix(), ws)
+	if ev.gen != aggGen {
+		return
+	}
+
+	qdata, ok := qbuf[ev.text]
+	if !ok {
+		qdata = newQueryData(ev.text)
+		qdata.values = ev.values
+	}
+	qdata.count++
+	qdata.bytes += ev.bytes
+	countChanged(qdata)
+	qdata.recent.add(ev.ts.Unix(), ws)
+}
+
+// countResponse records the timing of a completed request, globally and
+// against its aggregation key if it was counted under one.
+func countResponse(ev *responseEvent) {
+	times.record(ev.reqtime)
+	ws := windowSlot{bytes: ev.bytes, timed: 1, timetotal: ev.reqtime}
+	recent.add(ev.ts.Unix(), ws)
+	if ev.streamed {
+		firsttimes.record(ev.firsttime)
+	}
+
+	// The query may have been evicted (see topk.go) since the request was
+	// counted, in which case there's nowhere to put this.
+	qdata, ok := qbuf[ev.text]
+	if ev.gen != aggGen || !ok {
+		return
+	}
+	qdata.times.record(ev.reqtime)
+	qdata.bytes += ev.bytes
+	qdata.recent.add(ev.ts.Unix(), ws)
+	switch ev.outcome {
+	case "notfound":
+		qdata.notfound++
+	case "error":
+		qdata.errors++
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/xb95/riak-sniffer/flow"
+	riak "github.com/xb95/riak-sniffer/proto"
+	"github.com/xb95/riak-sniffer/riakpb"
+)
+
+func TestMain(m *testing.M) {
+	startAggregator()
+	os.Exit(m.Run())
+}
+
+// A testConn builds the frames for one client connection to port 8087, as
+// raw IPv4 packets.
+type testConn struct {
+	client [4]byte
+	port   uint16
+	seq    [2]uint32 // next sequence number, indexed by flow.Direction
+}
+
+func newTestConn(n int) *testConn {
+	return &testConn{client: [4]byte{10, 0, byte(n >> 8), byte(n)},
+		port: uint16(40000 + n), seq: [2]uint32{1000, 5000}}
+}
+
+func (c *testConn) frame(dir flow.Direction, flags byte, payload []byte) []byte {
+	b := make([]byte, 40, 40+len(payload))
+	b[0] = 0x45
+	b[2], b[3] = byte((40+len(payload))>>8), byte(40+len(payload))
+	b[9] = 6
+
+	server := [4]byte{10, 1, 0, 1}
+	src, dst, sport, dport := c.client, server, c.port, uint16(8087)
+	if dir == flow.ToClient {
+		src, dst, sport, dport = server, c.client, dport, sport
+	}
+	copy(b[12:16], src[:])
+	copy(b[16:20], dst[:])
+
+	tcp := b[20:]
+	tcp[0], tcp[1], tcp[2], tcp[3] = byte(sport>>8), byte(sport),
+		byte(dport>>8), byte(dport)
+	seq := c.seq[dir]
+	tcp[4], tcp[5], tcp[6], tcp[7] = byte(seq>>24), byte(seq>>16),
+		byte(seq>>8), byte(seq)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+
+	c.seq[dir] += uint32(len(payload))
+	if flags&flow.TCP_SYN != 0 {
+		c.seq[dir]++
+	}
+	return append(b, payload...)
+}
+
+// encode frames a message, failing the test if it can't.
+func encode(t *testing.T, code int, msg proto.Message) []byte {
+	data, err := riakpb.EncodeFrame(code, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// resetAggregation puts the aggregator back to a clean slate.
+func resetAggregation() {
+	aggregate(func() {
+		qbuf, qheap, querycount = make(map[string]*queryData), nil, 0
+		times, firsttimes, synctimes = histogram{}, histogram{}, histogram{}
+		recent = window{}
+	})
+}
+
+// Lots of clients at once, each with its own listener goroutine, all feeding
+// the one aggregator.
+func TestConcurrentStreams(t *testing.T) {
+	const clients, requests = 20, 50
+	parseFormat("#m #b")
+	parsePercentiles("50,99")
+	if err := parseSort("count"); err != nil {
+		t.Fatal(err)
+	}
+	statusPeriod, verbose, jsonOutput = 10, false, false
+	resetAggregation()
+	defer resetAggregation()
+	streams := atomic.LoadUint64(&stats.streams)
+	syncs := atomic.LoadUint64(&stats.syncs)
+
+	tracker, err := flow.NewTracker(flow.DLT_RAW, 8087, riakHandler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every client connects, then they take turns sending a request and
+	// getting the response 2ms later, gets and puts alternating.
+	clock := time.Unix(1000, 0)
+	packet := func(c *testConn, dir flow.Direction, flags byte, payload []byte) {
+		if err := tracker.Packet(clock, c.frame(dir, flags, payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conns := make([]*testConn, clients)
+	for i := range conns {
+		conns[i] = newTestConn(i)
+		packet(conns[i], flow.ToServer, flow.TCP_SYN, nil)
+		packet(conns[i], flow.ToClient, flow.TCP_SYN, nil)
+	}
+	if tracker.Len() != clients {
+		t.Fatalf("tracking %d flows, want %d", tracker.Len(), clients)
+	}
+
+	get := encode(t, riakpb.MsgGetReq, &riak.RpbGetReq{Bucket: []byte("users"),
+		Key: []byte("k")})
+	getResp := encode(t, riakpb.MsgGetResp, &riak.RpbGetResp{
+		Content: []*riak.RpbContent{{Value: []byte("value")}}})
+	put := encode(t, riakpb.MsgPutReq, &riak.RpbPutReq{Bucket: []byte("users"),
+		Key: []byte("k"), Content: &riak.RpbContent{Value: []byte("value")}})
+	putResp := encode(t, riakpb.MsgPutResp, nil)
+	for r := 0; r < requests; r++ {
+		req, resp := get, getResp
+		if r%2 == 1 {
+			req, resp = put, putResp
+		}
+		for _, c := range conns {
+			clock = clock.Add(time.Millisecond)
+			packet(c, flow.ToServer, 0, req)
+		}
+		clock = clock.Add(2 * time.Millisecond)
+		for _, c := range conns {
+			packet(c, flow.ToClient, 0, resp)
+		}
+	}
+
+	tracker.CloseAll()
+	wg.Wait()
+
+	aggregate(func() {
+		if querycount != clients*requests {
+			t.Errorf("querycount = %d, want %d", querycount, clients*requests)
+		}
+		for _, method := range []string{"get", "put"} {
+			q := qbuf[method+" users"]
+			if q == nil {
+				t.Errorf("no %s in qbuf", method)
+				continue
+			}
+			if q.count != clients*requests/2 {
+				t.Errorf("%s count = %d, want %d", method, q.count,
+					clients*requests/2)
+			}
+			if q.times.count != clients*requests/2 {
+				t.Errorf("%s times.count = %d, want %d", method,
+					q.times.count, clients*requests/2)
+			}
+		}
+		if len(qbuf) != 2 {
+			t.Errorf("%d queries in qbuf, want 2", len(qbuf))
+		}
+		if times.count != clients*requests {
+			t.Errorf("times.count = %d, want %d", times.count, clients*requests)
+		}
+
+		// Each one synced on its first request, which takes no time at all.
+		if synctimes.count != clients {
+			t.Errorf("synctimes.count = %d, want %d", synctimes.count, clients)
+		}
+		if synctimes.max != 0 {
+			t.Errorf("synctimes.max = %d, want 0", synctimes.max)
+		}
+	})
+
+	if got := atomic.LoadUint64(&stats.streams) - streams; got != clients {
+		t.Errorf("%d new streams, want %d", got, clients)
+	}
+	if got := atomic.LoadUint64(&stats.syncs) - syncs; got != clients {
+		t.Errorf("%d syncs, want %d", got, clients)
+	}
+}
+
+// A client that pipelines gets answers in order, and the one aggregator sees
+// all of them.
+func TestPipelinedStream(t *testing.T) {
+	parseFormat("#m #b:#k")
+	parsePercentiles("50")
+	if err := parseSort("count"); err != nil {
+		t.Fatal(err)
+	}
+	statusPeriod, verbose, jsonOutput = 10, false, false
+	resetAggregation()
+	defer resetAggregation()
+
+	tracker, err := flow.NewTracker(flow.DLT_RAW, 8087, riakHandler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestConn(1000)
+	clock := time.Unix(2000, 0)
+	tracker.Packet(clock, c.frame(flow.ToServer, flow.TCP_SYN, nil))
+
+	// Five requests in one segment, then the responses split awkwardly over
+	// two segments.
+	var reqs, resps []byte
+	for i := 0; i < 5; i++ {
+		reqs = append(reqs, encode(t, riakpb.MsgGetReq, &riak.RpbGetReq{
+			Bucket: []byte("b"), Key: []byte(fmt.Sprintf("k%d", i%2))})...)
+		resps = append(resps, encode(t, riakpb.MsgGetResp, nil)...)
+	}
+	tracker.Packet(clock, c.frame(flow.ToServer, 0, reqs))
+	clock = clock.Add(time.Millisecond)
+	tracker.Packet(clock, c.frame(flow.ToClient, 0, resps[:7]))
+	clock = clock.Add(time.Millisecond)
+	tracker.Packet(clock, c.frame(flow.ToClient, 0, resps[7:]))
+	tracker.CloseAll()
+	wg.Wait()
+
+	aggregate(func() {
+		if querycount != 5 {
+			t.Errorf("querycount = %d, want 5", querycount)
+		}
+		if q := qbuf["get b:k0"]; q == nil || q.count != 3 || q.times.count != 3 {
+			t.Errorf("get b:k0 = %+v", q)
+		}
+		if q := qbuf["get b:k1"]; q == nil || q.count != 2 || q.times.count != 2 {
+			t.Errorf("get b:k1 = %+v", q)
+		}
+		if times.count != 5 {
+			t.Errorf("times.count = %d, want 5", times.count)
+		}
+	})
+}
+
+// A response buffer that starts with a nonsense length, like the tail of a
+// response we came in halfway through, loses our place instead of crashing or
+// buffering forever. The next request gets us going again.
+func TestBadFrameLength(t *testing.T) {
+	parseFormat("#m #b")
+	parsePercentiles("50")
+	if err := parseSort("count"); err != nil {
+		t.Fatal(err)
+	}
+	statusPeriod, verbose, jsonOutput = 10, false, false
+	resetAggregation()
+	defer resetAggregation()
+	desyncs := atomic.LoadUint64(&stats.desyncs)
+
+	tracker, err := flow.NewTracker(flow.DLT_RAW, 8087, riakHandler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := encode(t, riakpb.MsgGetReq, &riak.RpbGetReq{Bucket: []byte("b"),
+		Key: []byte("k")})
+	getResp := encode(t, riakpb.MsgGetResp, nil)
+
+	for _, garbage := range [][]byte{
+		{0xff, 0xff, 0xff, 0xfd, 0x0a, 1, 2, 3}, // wraps around
+		{0x7f, 0, 0, 0, 0x0a, 1, 2, 3},          // just huge
+	} {
+		c := newTestConn(2000)
+		clock := time.Unix(3000, 0)
+		tracker.Packet(clock, c.frame(flow.ToServer, flow.TCP_SYN, nil))
+		tracker.Packet(clock, c.frame(flow.ToServer, 0, get))
+		tracker.Packet(clock, c.frame(flow.ToClient, 0, garbage))
+		clock = clock.Add(time.Millisecond)
+		tracker.Packet(clock, c.frame(flow.ToServer, 0, get))
+		clock = clock.Add(time.Millisecond)
+		tracker.Packet(clock, c.frame(flow.ToClient, 0, getResp))
+		tracker.CloseAll()
+	}
+	wg.Wait()
+
+	aggregate(func() {
+		if querycount != 4 {
+			t.Errorf("querycount = %d, want 4", querycount)
+		}
+		if times.count != 2 {
+			t.Errorf("times.count = %d, want 2", times.count)
+		}
+	})
+	if got := atomic.LoadUint64(&stats.desyncs) - desyncs; got != 2 {
+		t.Errorf("%d desyncs, want 2", got)
+	}
+}
@@ -0,0 +1,465 @@
+/*
+ * filter.go
+ *
+ * Narrows down which requests we care about, for when it's one bucket or one
+ * badly behaved client that's interesting. A filter is an expression like
+ *
+ *     bucket = users and (method in get,put or latency > 50ms)
+ *
+ * and requests that don't match it are ignored, as if we'd never seen them.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xb95/riak-sniffer/riakpb"
+)
+
+// A filterFunc tells if a request matches. res is nil unless the filter needs
+// the response.
+type filterFunc func(rs *riakSource, req *riakRequest, res *riakpb.Response) bool
+
+// requestFilter is nil if the user didn't give us one. It never changes after
+// startup, so it doesn't need a lock.
+var requestFilter filterFunc
+var filterNeedsResponse bool
+
+// requestMatches tells if a request gets past the user's filter.
+func requestMatches(rs *riakSource, req *riakRequest, res *riakpb.Response) bool {
+	return requestFilter == nil || requestFilter(rs, req, res)
+}
+
+// How to get at the value of each field we can filter on. Strings can be
+// compared with =, !=, ~ (glob), =~ (regex) or in (comma separated list).
+var filterStrings = map[string]func(rs *riakSource, req *riakRequest,
+	res *riakpb.Response) string{
+	"bucket": func(rs *riakSource, req *riakRequest, res *riakpb.Response) string {
+		return string(req.Request.Bucket)
+	},
+	"key": func(rs *riakSource, req *riakRequest, res *riakpb.Response) string {
+		return string(req.Request.Key)
+	},
+	"method": func(rs *riakSource, req *riakRequest, res *riakpb.Response) string {
+		return req.Request.Method
+	},
+	"outcome": func(rs *riakSource, req *riakRequest, res *riakpb.Response) string {
+		return res.Outcome
+	},
+}
+
+// Numbers can be compared with =, !=, <, <=, > and >=. Latency is in
+// nanoseconds, sizes in bytes.
+var filterNumbers = map[string]func(rs *riakSource, req *riakRequest,
+	res *riakpb.Response) uint64{
+	"latency": func(rs *riakSource, req *riakRequest, res *riakpb.Response) uint64 {
+		return uint64(req.Latency().Nanoseconds())
+	},
+	"size": func(rs *riakSource, req *riakRequest, res *riakpb.Response) uint64 {
+		return req.ResponseBytes
+	},
+	"reqsize": func(rs *riakSource, req *riakRequest, res *riakpb.Response) uint64 {
+		return req.RequestBytes
+	},
+}
+
+// Fields we don't know until the response is in.
+var filterResponseFields = map[string]bool{"outcome": true, "latency": true,
+	"size": true}
+
+// One token of a filter expression. quoted is so that a quoted "and" is a
+// value rather than the operator.
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+var filterOps = []string{"=~", "!=", "<=", ">=", "==", "&&", "||", "=", "~",
+	"<", ">", "!"}
+
+// lexFilter splits up an expression. Values with spaces, parentheses or any of
+// the operator characters in them have to be in double quotes, except for the
+// spaces around the commas in a list.
+func lexFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, filterToken{text: string(c)})
+			i++
+		case c == '"':
+			end := i + 1
+			for ; end < len(expr) && expr[end] != '"'; end++ {
+				if expr[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(expr) {
+				return nil, errors.New("unterminated quoted string")
+			}
+			text, err := strconv.Unquote(expr[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("bad quoted string %s", expr[i:end+1])
+			}
+			tokens = append(tokens, filterToken{text: text, quoted: true})
+			i = end + 1
+		case strings.IndexByte("=!<>~&|", c) >= 0:
+			op := ""
+			for _, o := range filterOps {
+				if strings.HasPrefix(expr[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unknown operator at %s", expr[i:])
+			}
+			tokens = append(tokens, filterToken{text: op})
+			i += len(op)
+		default:
+			// A list like "get, put" is one value, spaces after (or before)
+			// the commas and all.
+			end := i
+			for end < len(expr) {
+				if strings.IndexByte(" \t()\"=!<>~&|", expr[end]) < 0 {
+					end++
+					continue
+				}
+				rest := strings.TrimLeft(expr[end:], " \t")
+				if len(rest) == len(expr[end:]) || rest == "" ||
+					(expr[end-1] != ',' && rest[0] != ',') {
+					break
+				}
+				end = len(expr) - len(rest)
+			}
+			tokens = append(tokens, filterToken{text: expr[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// A filterParser is a recursive descent parser over the tokens, lowest
+// precedence first: or, and, not, then comparisons.
+type filterParser struct {
+	tokens        []filterToken
+	pos           int
+	needsResponse bool
+}
+
+// parseFilter compiles a filter expression, and tells if it needs the
+// response to be known.
+func parseFilter(expr string) (filterFunc, bool, error) {
+	tokens, err := lexFilter(expr)
+	if err != nil {
+		return nil, false, err
+	}
+	p := &filterParser{tokens: tokens}
+	fn, err := p.parseOr()
+	if err != nil {
+		return nil, false, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, false, fmt.Errorf("unexpected %s in filter", p.tokens[p.pos].text)
+	}
+	return fn, p.needsResponse, nil
+}
+
+// accept tells if the next token is one of the given (unquoted) words, and
+// moves past it if so.
+func (p *filterParser) accept(words ...string) bool {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].quoted {
+		return false
+	}
+	for _, word := range words {
+		if strings.ToLower(p.tokens[p.pos].text) == word {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *filterParser) next() (filterToken, error) {
+	if p.pos >= len(p.tokens) {
+		return filterToken{}, errors.New("filter ends too soon")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *filterParser) parseOr() (filterFunc, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("or", "||") {
+		a, b := left, filterFunc(nil)
+		if b, err = p.parseAnd(); err != nil {
+			return nil, err
+		}
+		left = func(rs *riakSource, req *riakRequest, res *riakpb.Response) bool {
+			return a(rs, req, res) || b(rs, req, res)
+		}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterFunc, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("and", "&&") {
+		a, b := left, filterFunc(nil)
+		if b, err = p.parseNot(); err != nil {
+			return nil, err
+		}
+		left = func(rs *riakSource, req *riakRequest, res *riakpb.Response) bool {
+			return a(rs, req, res) && b(rs, req, res)
+		}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (filterFunc, error) {
+	if p.accept("not", "!") {
+		fn, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(rs *riakSource, req *riakRequest, res *riakpb.Response) bool {
+			return !fn(rs, req, res)
+		}, nil
+	}
+	if p.accept("(") {
+		fn, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, errors.New("missing ) in filter")
+		}
+		return fn, nil
+	}
+	return p.parseComparison()
+}
+
+// parseComparison handles "field op value".
+func (p *filterParser) parseComparison() (filterFunc, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	field := strings.ToLower(tok.text)
+	optok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	op := strings.ToLower(optok.text)
+	valtok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	val := valtok.text
+	if filterResponseFields[field] {
+		p.needsResponse = true
+	}
+
+	if get, ok := filterStrings[field]; ok {
+		return stringFilter(field, get, op, val)
+	}
+	if get, ok := filterNumbers[field]; ok {
+		return numberFilter(field, get, op, val)
+	}
+	if field == "client" {
+		return clientFilter(op, val)
+	}
+	return nil, fmt.Errorf("unknown filter field %s", tok.text)
+}
+
+// stringFilter compares one of the filterStrings.
+func stringFilter(field string, get func(*riakSource, *riakRequest,
+	*riakpb.Response) string, op, val string) (filterFunc, error) {
+	var match func(string) bool
+	switch op {
+	case "=", "==":
+		match = func(s string) bool { return s == val }
+	case "!=":
+		match = func(s string) bool { return s != val }
+	case "in":
+		set := make(map[string]bool)
+		for _, item := range strings.Split(val, ",") {
+			set[strings.TrimSpace(item)] = true
+		}
+		match = func(s string) bool { return set[s] }
+	case "~", "=~":
+		pattern := val
+		if op == "~" {
+			pattern = globToRegexp(val)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern for %s: %s", field, err)
+		}
+		match = re.MatchString
+	default:
+		return nil, fmt.Errorf("can't use %s with %s", op, field)
+	}
+	return func(rs *riakSource, req *riakRequest, res *riakpb.Response) bool {
+		return match(get(rs, req, res))
+	}, nil
+}
+
+// globToRegexp turns a shell style pattern (*, ? and [...]) into an anchored
+// regular expression.
+func globToRegexp(glob string) string {
+	re := "^"
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			re += ".*"
+		case '?':
+			re += "."
+		case '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				re += `\[`
+				continue
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re += "[" + class + "]"
+			i += end
+		default:
+			re += regexp.QuoteMeta(string(c))
+		}
+	}
+	return re + "$"
+}
+
+// numberFilter compares one of the filterNumbers.
+func numberFilter(field string, get func(*riakSource, *riakRequest,
+	*riakpb.Response) uint64, op, val string) (filterFunc, error) {
+	var limit uint64
+	var err error
+	if field == "latency" {
+		limit, err = parseLatency(val)
+	} else {
+		limit, err = parseSize(val)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bad value for %s: %s", field, val)
+	}
+
+	var match func(uint64) bool
+	switch op {
+	case "=", "==":
+		match = func(n uint64) bool { return n == limit }
+	case "!=":
+		match = func(n uint64) bool { return n != limit }
+	case "<":
+		match = func(n uint64) bool { return n < limit }
+	case "<=":
+		match = func(n uint64) bool { return n <= limit }
+	case ">":
+		match = func(n uint64) bool { return n > limit }
+	case ">=":
+		match = func(n uint64) bool { return n >= limit }
+	default:
+		return nil, fmt.Errorf("can't use %s with %s", op, field)
+	}
+	return func(rs *riakSource, req *riakRequest, res *riakpb.Response) bool {
+		return match(get(rs, req, res))
+	}, nil
+}
+
+// parseLatency takes a duration like 50ms or 1.5s, or a plain number of
+// milliseconds like -l does, and returns nanoseconds.
+func parseLatency(val string) (uint64, error) {
+	if ms, err := strconv.ParseFloat(val, 64); err == nil && ms >= 0 {
+		return uint64(ms * float64(time.Millisecond)), nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		return 0, errors.New("bad duration")
+	}
+	return uint64(d.Nanoseconds()), nil
+}
+
+// parseSize takes a number of bytes, optionally with a k, m or g suffix.
+func parseSize(val string) (uint64, error) {
+	mult := uint64(1)
+	if n := len(val); n > 0 {
+		switch val[n-1] {
+		case 'k', 'K':
+			mult, val = 1<<10, val[:n-1]
+		case 'm', 'M':
+			mult, val = 1<<20, val[:n-1]
+		case 'g', 'G':
+			mult, val = 1<<30, val[:n-1]
+		}
+	}
+	n, err := strconv.ParseUint(val, 10, 64)
+	return n * mult, err
+}
+
+// clientFilter matches the client's IP against addresses or CIDR ranges.
+func clientFilter(op, val string) (filterFunc, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(val, ",") {
+		item = strings.TrimSpace(item)
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("bad client address %s", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("bad client range %s", item)
+		}
+		nets = append(nets, ipnet)
+	}
+
+	if len(nets) > 1 && op != "in" {
+		return nil, fmt.Errorf("use in for a list of clients")
+	}
+	negate := false
+	switch op {
+	case "=", "==", "in":
+	case "!=":
+		negate = true
+	default:
+		return nil, fmt.Errorf("can't use %s with client", op)
+	}
+
+	return func(rs *riakSource, req *riakRequest, res *riakpb.Response) bool {
+		ip := net.ParseIP(rs.srcip)
+		for _, ipnet := range nets {
+			if ip != nil && ipnet.Contains(ip) {
+				return !negate
+			}
+		}
+		return negate
+	}, nil
+}
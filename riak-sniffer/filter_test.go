@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xb95/riak-sniffer/riakpb"
+)
+
+// filterRequest makes a finished request to run filters against.
+func filterRequest(client, method, bucket, key, outcome string,
+	latency time.Duration, reqsize, size uint64) (*riakSource, *riakRequest) {
+	sent := time.Unix(1000, 0)
+	rs := &riakSource{src: client + ":5000", srcip: client}
+	req := &riakRequest{Transaction: &riakpb.Transaction{
+		Sent:      sent,
+		Completed: sent.Add(latency),
+		Request: &riakpb.Request{Method: method, Bucket: []byte(bucket),
+			Key: []byte(key)},
+		RequestBytes:  reqsize,
+		ResponseBytes: size,
+		Response:      &riakpb.Response{Outcome: outcome},
+	}}
+	return rs, req
+}
+
+func TestFilter(t *testing.T) {
+	type sample struct {
+		rs  *riakSource
+		req *riakRequest
+	}
+	var samples []sample
+	for _, s := range []struct {
+		client, method, bucket, key, outcome string
+		latency                              time.Duration
+		reqsize, size                        uint64
+	}{
+		{"10.3.1.2", "get", "users", "alice", "ok", 20 * time.Millisecond, 30, 2048},
+		{"10.4.0.1", "put", "users", "bob", "ok", 120 * time.Millisecond, 5000, 0},
+		{"192.168.0.7", "get", "sessions", "a1b2", "notfound", 2 * time.Millisecond, 10, 0},
+		{"2001:db8::1", "delete", "my bucket", "x(y)", "error", 1500 * time.Millisecond, 10, 0},
+		{"10.3.9.9", "ping", "", "", "ok", 500 * time.Microsecond, 0, 0},
+	} {
+		rs, req := filterRequest(s.client, s.method, s.bucket, s.key, s.outcome,
+			s.latency, s.reqsize, s.size)
+		samples = append(samples, sample{rs, req})
+	}
+
+	tests := []struct {
+		expr          string
+		want          string // which samples match
+		needsResponse bool
+	}{
+		{"bucket = users", "0 1", false},
+		{"bucket == users", "0 1", false},
+		{"bucket != users", "2 3 4", false},
+		{"METHOD = get AND bucket = users", "0", false},
+
+		// Precedence: not, then and, then or.
+		{"bucket = users and method = put or key = a1b2", "1 2", false},
+		{"bucket = users and (method = put or key = a1b2)", "1", false},
+		{"not bucket = users and method = get", "2", false},
+		{"not (bucket = users and method = get)", "1 2 3 4", false},
+		{"! method = ping && bucket != sessions", "0 1 3", false},
+		{"method = get || method = ping", "0 2 4", false},
+		{"not not method = ping", "4", false},
+
+		// Lists, with or without spaces.
+		{"method in get,put", "0 1 2", false},
+		{"method in get, put", "0 1 2", false},
+		{"method in get ,put", "0 1 2", false},
+		{"method in get, put and bucket = sessions", "2", false},
+		{"method in delete, ping or bucket = sessions", "2 3 4", false},
+		{`method in "get, put"`, "0 1 2", false},
+
+		// Quoting.
+		{`bucket = "my bucket"`, "3", false},
+		{`key = "x(y)"`, "3", false},
+		{`bucket = "and"`, "", false},
+		{`key = "al\x69ce"`, "0", false},
+
+		// Globs and regular expressions.
+		{"key ~ a*", "0 2", false},
+		{"key ~ b?b", "1", false},
+		{`key ~ "[!a]*"`, "1 3", false},
+		{"bucket ~ sess*", "2", false},
+		{"key ~ li", "", false},
+		{"key =~ li", "0", false},
+		{"key =~ ^a[0-9]", "2", false},
+
+		// Clients.
+		{"client = 10.3.1.2", "0", false},
+		{"client in 10.3.0.0/16", "0 4", false},
+		{"client in 10.3.0.0/16, 192.168.0.0/24", "0 2 4", false},
+		{"client != 10.0.0.0/8", "2 3", false},
+		{"client = 2001:db8::/32", "3", false},
+		{"client != 2001:db8::1", "0 1 2 4", false},
+
+		// Numbers and units.
+		{"latency > 100", "1 3", true},
+		{"latency >= 20ms", "0 1 3", true},
+		{"latency < 1ms", "4", true},
+		{"latency <= 1.5s", "0 1 2 3 4", true},
+		{"latency = 2ms", "2", true},
+		{"size >= 2k", "0", true},
+		{"size > 2k", "", true},
+		{"reqsize > 4k", "1", false},
+		{"reqsize = 10", "2 3", false},
+		{"reqsize != 0", "0 1 2 3", false},
+		{"outcome = notfound", "2", true},
+		{"bucket = users or outcome = error", "0 1 3", true},
+	}
+
+	for _, test := range tests {
+		fn, needsResponse, err := parseFilter(test.expr)
+		if err != nil {
+			t.Errorf("%s: %s", test.expr, err)
+			continue
+		}
+		var got []string
+		for i, s := range samples {
+			if fn(s.rs, s.req, s.req.Response) {
+				got = append(got, fmt.Sprint(i))
+			}
+		}
+		if strings.Join(got, " ") != test.want {
+			t.Errorf("%s: matched %q, want %q", test.expr, strings.Join(got, " "),
+				test.want)
+		}
+		if needsResponse != test.needsResponse {
+			t.Errorf("%s: needsResponse is %v", test.expr, needsResponse)
+		}
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	tests := map[string]string{
+		"":                                   "ends too soon",
+		"bucket":                             "ends too soon",
+		"bucket = users and":                 "ends too soon",
+		"bucket users x":                     "can't use users with bucket",
+		"colour = red":                       "unknown filter field",
+		"bucket = users)":                    "unexpected )",
+		"(bucket = users":                    "missing )",
+		"bucket & users":                     "unknown operator",
+		`bucket = "users`:                    "unterminated",
+		`bucket = "a\q"`:                     "bad quoted string",
+		`key =~ "("`:                         "bad pattern for key",
+		"latency > soon":                     "bad value for latency",
+		"latency > -5":                       "bad value for latency",
+		"size < 3x":                          "bad value for size",
+		"size ~ 3":                           "can't use ~ with size",
+		"method < get":                       "can't use < with method",
+		"client = nowhere":                   "bad client address",
+		"client in 10.0.0.0/33":              "bad client range",
+		"client = 10.0.0.0/8, 10.1.0.0/16":   "use in for a list",
+		"client > 10.0.0.1":                  "can't use > with client",
+		"method in get, put bucket = users":  "unexpected bucket",
+		"not (method = get or)":              "ends too soon",
+		"bucket = users and not":             "ends too soon",
+		"bucket = users or (key = a) extras": "unexpected extras",
+	}
+	for expr, want := range tests {
+		_, _, err := parseFilter(expr)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: error %v, want %q", expr, err, want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * histogram.go
+ *
+ * Latency histograms with logarithmic buckets, in the style of HdrHistogram.
+ * Each power of two is split into a fixed number of linear sub-buckets, so
+ * the error on any value we report is bounded relative to the value itself,
+ * no matter whether it's 200us or 20s.
+ *
+ */
+
+package main
+
+import (
+	"math"
+	"math/bits"
+)
+
+const (
+	// Each power of two gets 2^histSubBits buckets. With 4 bits, reporting the
+	// middle of a bucket is within 1/32 (~3%) of the real value.
+	histSubBits  = 4
+	histSubCount = 1 << histSubBits
+
+	// Values are bucketed in microseconds, up to 2^32us (a bit over an hour).
+	// Anything bigger ends up in the last bucket.
+	histMaxBits = 32
+	histBuckets = (histMaxBits - histSubBits + 1) * histSubCount
+)
+
+// A histogram of nanosecond timings. The count, total, min and max are exact,
+// percentiles come from the buckets.
+//
+// There's one of these for every query we're tracking, so rather than having
+// every bucket, counts only covers the ones from the fastest reading to the
+// slowest, starting at bucket number base. Timings for any one query tend to
+// be fairly close together, so that's usually a few dozen.
+type histogram struct {
+	counts []uint64
+	base   int
+	count  uint64
+	total  uint64
+	min    uint64
+	max    uint64
+}
+
+// histIndex returns the bucket a number of microseconds goes in.
+func histIndex(us uint64) int {
+	if us < histSubCount {
+		return int(us)
+	}
+	if us >= 1<<histMaxBits {
+		return histBuckets - 1
+	}
+
+	// Shift the value down so that it has histSubBits+1 significant bits,
+	// the top one of which is always set so we don't need to store it.
+	shift := bits.Len64(us) - histSubBits - 1
+	return (shift+1)<<histSubBits + int(us>>uint(shift)) - histSubCount
+}
+
+// histValue returns the middle of a bucket, in nanoseconds.
+func histValue(idx int) uint64 {
+	if idx < histSubCount {
+		return uint64(idx)*1000 + 500
+	}
+
+	shift := uint(idx>>histSubBits - 1)
+	low := uint64(idx&(histSubCount-1)+histSubCount) << shift
+	return (low*2 + 1<<shift) * 500
+}
+
+// record adds a timing to the histogram. 0 is a real reading, like a stream
+// that synced on the first packet we saw of it.
+func (h *histogram) record(val uint64) {
+	idx := histIndex(val / 1000)
+	switch {
+	case len(h.counts) == 0:
+		h.counts, h.base = make([]uint64, 1, 4), idx
+	case idx < h.base:
+		counts := make([]uint64, h.base-idx+len(h.counts))
+		copy(counts[h.base-idx:], h.counts)
+		h.counts, h.base = counts, idx
+	case idx >= h.base+len(h.counts):
+		h.counts = append(h.counts, make([]uint64, idx-h.base-len(h.counts)+1)...)
+	}
+	h.counts[idx-h.base]++
+
+	if val < h.min || h.count == 0 {
+		h.min = val
+	}
+	if val > h.max {
+		h.max = val
+	}
+	h.count++
+	h.total += val
+}
+
+// percentile returns the timing that p percent of the readings are at or
+// below, in nanoseconds.
+func (h *histogram) percentile(p float64) uint64 {
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(p / 100 * float64(h.count)))
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen uint64
+	for i, count := range h.counts {
+		seen += count
+		if seen < rank {
+			continue
+		}
+
+		// The bucket might be wider than the values we've actually seen.
+		val := histValue(h.base + i)
+		if val < h.min {
+			val = h.min
+		}
+		if val > h.max {
+			val = h.max
+		}
+		return val
+	}
+	return h.max
+}
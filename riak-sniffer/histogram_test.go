@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// Percentiles come out within a bucket's width of the real thing, whichever
+// order the readings turn up in and however far apart they are.
+func TestHistogramPercentiles(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, spread := range []uint64{1000, 1000000, 10000000000} {
+		var h histogram
+		var vals []uint64
+		for i := 0; i < 1000; i++ {
+			val := uint64(r.Int63n(int64(spread)))
+			h.record(val)
+			vals = append(vals, val)
+		}
+		sort.Slice(vals, func(i, j int) bool { return vals[i] < vals[j] })
+
+		if h.count != 1000 || h.min != vals[0] || h.max != vals[999] {
+			t.Errorf("spread %d: count %d, min %d, max %d", spread, h.count,
+				h.min, h.max)
+		}
+		for _, p := range []float64{1, 50, 90, 99, 99.9, 100} {
+			want := vals[int(p*10+0.5)-1]
+			got := h.percentile(p)
+			if diff := int64(got) - int64(want); diff*32 > int64(want)+32000 ||
+				-diff*32 > int64(want)+32000 {
+				t.Errorf("spread %d: p%g = %d, want about %d", spread, p, got,
+					want)
+			}
+		}
+	}
+}
+
+// Buckets are only kept for the range of readings seen.
+func TestHistogramSparse(t *testing.T) {
+	var h histogram
+	if h.percentile(50) != 0 {
+		t.Error("empty histogram has a p50")
+	}
+
+	h.record(5000000)
+	if len(h.counts) != 1 {
+		t.Errorf("%d buckets for one reading", len(h.counts))
+	}
+	h.record(5100000)
+	h.record(4900000)
+	if len(h.counts) > 3 {
+		t.Errorf("%d buckets for readings close together", len(h.counts))
+	}
+
+	// Growing in both directions keeps what's already there.
+	h.record(0)
+	h.record(1 << 50)
+	if h.percentile(20) > 1000 || h.percentile(100) != histValue(histBuckets-1) {
+		t.Errorf("p20 %d, p100 %d", h.percentile(20), h.percentile(100))
+	}
+	if p := h.percentile(60); p < 4800000 || p > 5200000 {
+		t.Errorf("p60 %d", p)
+	}
+	var total uint64
+	for _, count := range h.counts {
+		total += count
+	}
+	if total != 5 || h.base != 0 || h.base+len(h.counts) != histBuckets {
+		t.Errorf("%d readings in buckets %d to %d", total, h.base,
+			h.base+len(h.counts))
+	}
+}
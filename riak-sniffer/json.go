@@ -0,0 +1,202 @@
+/*
+ * json.go
+ *
+ * JSON Lines output, for when the results are going to a program instead of
+ * a person. Every completed request (in verbose mode) or status update is a
+ * single JSON object on its own line on stdout.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xb95/riak-sniffer/riakpb"
+)
+
+var jsonOutput bool
+
+// Listeners all write requests at once, so access to stdout is serialized.
+var jsonLock sync.Mutex
+var jsonEncoder = json.NewEncoder(os.Stdout)
+
+type jsonRequest struct {
+	Time          time.Time `json:"time"`
+	Client        string    `json:"client"`
+	Method        string    `json:"method"`
+	Bucket        string    `json:"bucket"`
+	Key           string    `json:"key"`
+	Query         string    `json:"query"`
+	RequestBytes  uint64    `json:"request_bytes"`
+	ResponseBytes uint64    `json:"response_bytes"`
+	LatencyMs     float64   `json:"latency_ms"`
+	Outcome       string    `json:"outcome"`
+	Error         string    `json:"error,omitempty"`
+	Siblings      int       `json:"siblings,omitempty"`
+	ValueBytes    uint64    `json:"value_bytes,omitempty"`
+	Items         uint64    `json:"items,omitempty"`
+	FirstFrameMs  float64   `json:"first_frame_ms,omitempty"`
+	R             *uint32   `json:"r,omitempty"`
+	W             *uint32   `json:"w,omitempty"`
+	PR            *uint32   `json:"pr,omitempty"`
+	PW            *uint32   `json:"pw,omitempty"`
+	DW            *uint32   `json:"dw,omitempty"`
+	RW            *uint32   `json:"rw,omitempty"`
+	Vclock        bool      `json:"vclock,omitempty"`
+}
+
+type jsonLatency struct {
+	MinMs       float64            `json:"min_ms"`
+	AvgMs       float64            `json:"avg_ms"`
+	MaxMs       float64            `json:"max_ms"`
+	Percentiles map[string]float64 `json:"percentiles_ms"`
+}
+
+type jsonRow struct {
+	Query       string             `json:"query"`
+	Count       uint64             `json:"count"`
+	Rate        float64            `json:"rate"`
+	Rates       map[string]float64 `json:"rates"`
+	AvgMs       map[string]float64 `json:"avg_ms"` // over the same windows
+	Latency     jsonLatency        `json:"latency"`
+	Bytes       uint64             `json:"bytes"`
+	NotFoundPct float64            `json:"notfound_pct"`
+	ErrorPct    float64            `json:"error_pct"`
+	Overcount   uint64             `json:"overcount,omitempty"`
+}
+
+type jsonStatus struct {
+	Time            time.Time          `json:"time"`
+	ElapsedSecs     float64            `json:"elapsed_secs"`
+	Queries         int                `json:"queries"`
+	Rate            float64            `json:"rate"`
+	Rates           map[string]float64 `json:"rates"`
+	AvgMs           map[string]float64 `json:"avg_ms"`
+	Latency         jsonLatency        `json:"latency"`
+	Packets         uint64             `json:"packets"`
+	SyncedPackets   uint64             `json:"synced_packets"`
+	Desyncs         uint64             `json:"desyncs"`
+	Gaps            uint64             `json:"gaps"`
+	Streams         uint64             `json:"streams"`
+	Syncs           uint64             `json:"syncs"`
+	OpenConns       uint64             `json:"open_connections"`
+	ClosedConns     uint64             `json:"closed_connections"`
+	ExpiredConns    uint64             `json:"expired_connections"`
+	Streamed        uint64             `json:"streamed_responses"`
+	StreamedItems   uint64             `json:"streamed_items"`
+	Pipelined       uint64             `json:"pipelined_requests"`
+	PipelineDepth   uint64             `json:"max_pipeline_depth"`
+	CountErrorBound uint64             `json:"count_error_bound,omitempty"`
+	Rows            []jsonRow          `json:"rows"`
+}
+
+func writeJSON(obj interface{}) {
+	jsonLock.Lock()
+	defer jsonLock.Unlock()
+	if err := jsonEncoder.Encode(obj); err != nil {
+		fatalf("Failed to write JSON: %s", err)
+	}
+}
+
+// getLatency converts a histogram into milliseconds for output.
+func getLatency(timings *histogram) jsonLatency {
+	var ret jsonLatency
+	ret.MinMs, ret.AvgMs, ret.MaxMs = calculateTimes(timings)
+	ret.Percentiles = make(map[string]float64)
+	for i, pval := range calculatePercentiles(timings) {
+		ret.Percentiles[fmt.Sprintf("p%g", percentiles[i])] = pval
+	}
+	return ret
+}
+
+// getRates returns the rates over the last interval and each window, keyed by
+// a short name for the window.
+func getRates(w *window, sec int64, elapsed float64) map[string]float64 {
+	ret := make(map[string]float64)
+	ret["last"] = windowRate(w.sum(sec, statusPeriod), statusPeriod, elapsed)
+	for _, length := range windowLengths {
+		ret[fmt.Sprintf("%dm", length/60)] = windowRate(w.sum(sec, length),
+			length, elapsed)
+	}
+	return ret
+}
+
+// getLatencies returns the average response time in milliseconds over the last
+// interval and each window, keyed like getRates.
+func getLatencies(w *window, sec int64) map[string]float64 {
+	ret := make(map[string]float64)
+	ret["last"] = windowLatency(w.sum(sec, statusPeriod))
+	for _, length := range windowLengths {
+		ret[fmt.Sprintf("%dm", length/60)] = windowLatency(w.sum(sec, length))
+	}
+	return ret
+}
+
+// getRequestJSON puts everything we know about a completed request into a
+// jsonRequest.
+func getRequestJSON(rs *riakSource, req *riakRequest, res *riakpb.Response,
+	ts time.Time, plen, reqtime, firsttime uint64) *jsonRequest {
+	msg := req.Request
+	obj := &jsonRequest{Time: ts, Client: rs.src, Method: msg.Method,
+		Bucket: safe_output(msg.Bucket), Key: safe_output(msg.Key),
+		Query: req.text, RequestBytes: req.RequestBytes, ResponseBytes: plen,
+		LatencyMs: float64(reqtime) / 1000000, Outcome: res.Outcome,
+		Error: safe_output(res.ErrMsg), Siblings: res.Siblings,
+		ValueBytes: res.ValueSize, R: msg.R, W: msg.W, PR: msg.PR, PW: msg.PW,
+		DW: msg.DW, RW: msg.RW, Vclock: msg.Vclock}
+	if req.Streamed() {
+		obj.Items, obj.FirstFrameMs = req.Items,
+			float64(firsttime)/1000000
+	}
+	return obj
+}
+
+// writeRequestJSON outputs a single completed request.
+func writeRequestJSON(rs *riakSource, req *riakRequest, res *riakpb.Response,
+	ts time.Time, plen, reqtime, firsttime uint64) {
+	writeJSON(getRequestJSON(rs, req, res, ts, plen, reqtime, firsttime))
+}
+
+// writeStatusJSON outputs everything a status update would show, and all of
+// the rows instead of just the top ones.
+func writeStatusJSON(elapsed float64) {
+	sec := aggNow.Unix()
+	obj := &jsonStatus{Time: aggNow, ElapsedSecs: elapsed, Queries: querycount,
+		Rate:            float64(querycount) / elapsed,
+		Rates:           getRates(&recent, sec, elapsed),
+		AvgMs:           getLatencies(&recent, sec),
+		Latency:         getLatency(&times),
+		Packets:         atomic.LoadUint64(&stats.packets.rcvd),
+		SyncedPackets:   atomic.LoadUint64(&stats.packets.rcvd_sync),
+		Desyncs:         atomic.LoadUint64(&stats.desyncs),
+		Gaps:            atomic.LoadUint64(&stats.gaps),
+		Streams:         atomic.LoadUint64(&stats.streams),
+		Syncs:           atomic.LoadUint64(&stats.syncs),
+		OpenConns:       openConns(),
+		ClosedConns:     atomic.LoadUint64(&stats.conns.closed),
+		ExpiredConns:    atomic.LoadUint64(&stats.conns.expired),
+		Streamed:        atomic.LoadUint64(&stats.streamed.responses),
+		StreamedItems:   atomic.LoadUint64(&stats.streamed.items),
+		Pipelined:       atomic.LoadUint64(&stats.pipeline.requests),
+		PipelineDepth:   atomic.LoadUint64(&stats.pipeline.maxdepth),
+		CountErrorBound: countErrorBound(),
+		Rows:            []jsonRow{},
+	}
+
+	for _, row := range getStatusRows(elapsed, sec) {
+		obj.Rows = append(obj.Rows, jsonRow{Query: row.query,
+			Count: row.count, Rate: row.rate,
+			Rates:   getRates(&row.data.recent, sec, elapsed),
+			AvgMs:   getLatencies(&row.data.recent, sec),
+			Latency: getLatency(&row.data.times), Bytes: row.bytes,
+			NotFoundPct: row.notfound, ErrorPct: row.errors,
+			Overcount: row.data.overcount})
+	}
+	writeJSON(obj)
+}
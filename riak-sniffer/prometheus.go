@@ -0,0 +1,200 @@
+/*
+ * prometheus.go
+ *
+ * An optional HTTP listener serving /metrics in the Prometheus text format,
+ * so the sniffer can run as a daemon and be scraped. We write the format
+ * ourselves rather than pull in the client library, it's simple enough.
+ *
+ * Requests are labelled by method and bucket only, never by key, and the
+ * number of distinct series is capped so a client hitting thousands of
+ * buckets can't blow up the label cardinality.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/xb95/riak-sniffer/riakpb"
+)
+
+// Upper bounds of the latency histogram buckets, in seconds.
+var promBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05,
+	0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Once we have this many method/bucket series, new buckets are lumped into
+// promOtherBucket.
+var promMaxSeries int
+
+const promOtherBucket = "_other"
+
+type promSeries struct {
+	method   string
+	bucket   string
+	requests uint64
+	notfound uint64
+	errors   uint64
+	counts   []uint64 // per promBuckets, not cumulative
+	sum      float64  // seconds
+}
+
+var promLock sync.Mutex
+var promSeriesMap map[string]*promSeries
+
+// startPrometheus starts serving metrics on the given address.
+func startPrometheus(addr string, maxSeries int) {
+	promMaxSeries = maxSeries
+	promSeriesMap = make(map[string]*promSeries)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	go func() {
+		fatalf("Failed to serve metrics: %s", http.ListenAndServe(addr, mux))
+	}()
+}
+
+// recordPrometheus adds a completed request to the metrics. It's a no-op if
+// the metrics endpoint isn't enabled.
+func recordPrometheus(msg *riakpb.Request, res *riakpb.Response, reqtime uint64) {
+	if promSeriesMap == nil {
+		return
+	}
+
+	promLock.Lock()
+	defer promLock.Unlock()
+
+	bucket := safe_output(msg.Bucket)
+	series, ok := promSeriesMap[msg.Method+"\x00"+bucket]
+	if !ok {
+		if len(promSeriesMap) >= promMaxSeries {
+			bucket = promOtherBucket
+			series, ok = promSeriesMap[msg.Method+"\x00"+bucket]
+		}
+		if !ok {
+			series = &promSeries{method: msg.Method, bucket: bucket,
+				counts: make([]uint64, len(promBuckets))}
+			promSeriesMap[msg.Method+"\x00"+bucket] = series
+		}
+	}
+
+	series.requests++
+	switch res.Outcome {
+	case "notfound":
+		series.notfound++
+	case "error":
+		series.errors++
+	}
+
+	secs := float64(reqtime) / 1e9
+	series.sum += secs
+	for i, le := range promBuckets {
+		if secs <= le {
+			series.counts[i]++
+			break
+		}
+	}
+}
+
+// promEscape escapes a label value.
+func promEscape(val string) string {
+	val = strings.Replace(val, `\`, `\\`, -1)
+	val = strings.Replace(val, `"`, `\"`, -1)
+	return strings.Replace(val, "\n", `\n`, -1)
+}
+
+func writeMetric(w *bufio.Writer, name, kind, help string, val interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name,
+		kind, name, val)
+}
+
+func handleMetrics(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w := bufio.NewWriter(rw)
+	defer w.Flush()
+
+	writeMetric(w, "riak_sniffer_packets_total", "counter",
+		"Packets with payload seen.", atomic.LoadUint64(&stats.packets.rcvd))
+	writeMetric(w, "riak_sniffer_synced_packets_total", "counter",
+		"Packets seen on synchronized streams.",
+		atomic.LoadUint64(&stats.packets.rcvd_sync))
+	writeMetric(w, "riak_sniffer_desyncs_total", "counter",
+		"Times a stream lost synchronization.",
+		atomic.LoadUint64(&stats.desyncs))
+	writeMetric(w, "riak_sniffer_syncs_total", "counter",
+		"Times a stream gained synchronization.",
+		atomic.LoadUint64(&stats.syncs))
+	writeMetric(w, "riak_sniffer_gaps_total", "counter",
+		"Times data was lost in TCP reassembly.",
+		atomic.LoadUint64(&stats.gaps))
+	writeMetric(w, "riak_sniffer_streams_total", "counter",
+		"Client connections seen.", atomic.LoadUint64(&stats.streams))
+	writeMetric(w, "riak_sniffer_connections_open", "gauge",
+		"Client connections currently open.", openConns())
+	writeMetric(w, "riak_sniffer_connections_closed_total", "counter",
+		"Connections closed by FIN or RST.",
+		atomic.LoadUint64(&stats.conns.closed))
+	writeMetric(w, "riak_sniffer_connections_expired_total", "counter",
+		"Connections expired for being idle.",
+		atomic.LoadUint64(&stats.conns.expired))
+
+	promLock.Lock()
+	defer promLock.Unlock()
+
+	keys := make([]string, 0, len(promSeriesMap))
+	for key := range promSeriesMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP riak_sniffer_requests_total Completed requests.\n")
+	fmt.Fprintf(w, "# TYPE riak_sniffer_requests_total counter\n")
+	for _, key := range keys {
+		s := promSeriesMap[key]
+		fmt.Fprintf(w, "riak_sniffer_requests_total{method=\"%s\",bucket=\"%s\"} %d\n",
+			s.method, promEscape(s.bucket), s.requests)
+	}
+
+	fmt.Fprintf(w, "# HELP riak_sniffer_notfound_total Requests that came back not found.\n")
+	fmt.Fprintf(w, "# TYPE riak_sniffer_notfound_total counter\n")
+	for _, key := range keys {
+		s := promSeriesMap[key]
+		fmt.Fprintf(w, "riak_sniffer_notfound_total{method=\"%s\",bucket=\"%s\"} %d\n",
+			s.method, promEscape(s.bucket), s.notfound)
+	}
+
+	fmt.Fprintf(w, "# HELP riak_sniffer_errors_total Requests that came back with an error.\n")
+	fmt.Fprintf(w, "# TYPE riak_sniffer_errors_total counter\n")
+	for _, key := range keys {
+		s := promSeriesMap[key]
+		fmt.Fprintf(w, "riak_sniffer_errors_total{method=\"%s\",bucket=\"%s\"} %d\n",
+			s.method, promEscape(s.bucket), s.errors)
+	}
+
+	fmt.Fprintf(w, "# HELP riak_sniffer_request_duration_seconds Time from request to last response frame.\n")
+	fmt.Fprintf(w, "# TYPE riak_sniffer_request_duration_seconds histogram\n")
+	for _, key := range keys {
+		s := promSeriesMap[key]
+		labels := fmt.Sprintf("method=\"%s\",bucket=\"%s\"", s.method,
+			promEscape(s.bucket))
+
+		var total uint64
+		for i, le := range promBuckets {
+			total += s.counts[i]
+			fmt.Fprintf(w, "riak_sniffer_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n",
+				labels, le, total)
+		}
+		fmt.Fprintf(w, "riak_sniffer_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n",
+			labels, s.requests)
+		fmt.Fprintf(w, "riak_sniffer_request_duration_seconds_sum{%s} %g\n",
+			labels, s.sum)
+		fmt.Fprintf(w, "riak_sniffer_request_duration_seconds_count{%s} %d\n",
+			labels, s.requests)
+	}
+}
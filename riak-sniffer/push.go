@@ -0,0 +1,220 @@
+/*
+ * push.go
+ *
+ * Pushes aggregated numbers to StatsD (over UDP) or Graphite (plaintext over
+ * TCP) once every status period, for dashboards that don't scrape. Metric
+ * names come from a template using the same tokens as the -f format, so
+ * "riak.#m.#b" gives one set of metrics per method and bucket.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xb95/riak-sniffer/riakpb"
+)
+
+// Keep StatsD packets small enough not to be fragmented on most networks.
+const pushMaxPacket = 1432
+
+// pushProto is "statsd" or "graphite", or empty if we aren't pushing.
+var pushProto string
+var pushAddr string
+var pushFormat []interface{}
+
+// What we've seen for one metric name since the last push.
+type pushStats struct {
+	count    uint64
+	bytes    uint64
+	notfound uint64
+	errors   uint64
+	times    histogram
+}
+
+var pushLock sync.Mutex
+var pushData map[string]*pushStats
+
+// startPush sets up pushing to a target like statsd://localhost:8125 or
+// graphite://localhost:2003, with metric names built from the template.
+func startPush(target, template string) error {
+	idx := strings.Index(target, "://")
+	if idx < 0 {
+		return fmt.Errorf("push target %s should look like statsd://host:port or graphite://host:port", target)
+	}
+	proto, addr := target[:idx], target[idx+3:]
+	if proto != "statsd" && proto != "graphite" {
+		return fmt.Errorf("unknown push protocol %s", proto)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("invalid push address %s: %s", addr, err)
+	}
+
+	pushFormat, _ = compileFormat(strings.TrimSpace(template))
+	pushProto, pushAddr = proto, addr
+	pushData = make(map[string]*pushStats)
+	return nil
+}
+
+// pushName makes a token value safe to use as one component of a metric name.
+// Dots would add levels to the Graphite tree, and StatsD also splits on colons
+// and pipes, so anything unusual becomes an underscore.
+func pushName(val string) string {
+	if val == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' ||
+			r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, val)
+}
+
+// recordPush adds a completed request to the next push. It's a no-op if we
+// aren't pushing anywhere.
+func recordPush(rs *riakSource, msg *riakpb.Request, res *riakpb.Response, plen,
+	reqtime uint64) {
+	if pushProto == "" {
+		return
+	}
+
+	var name string
+	for _, item := range pushFormat {
+		switch item.(type) {
+		case int:
+			name += pushName(formatToken(item.(int), rs, msg, res))
+		case string:
+			name += item.(string)
+		}
+	}
+
+	pushLock.Lock()
+	defer pushLock.Unlock()
+
+	ps, ok := pushData[name]
+	if !ok {
+		ps = &pushStats{}
+		pushData[name] = ps
+	}
+	ps.count++
+	ps.bytes += plen
+	switch res.Outcome {
+	case "notfound":
+		ps.notfound++
+	case "error":
+		ps.errors++
+	}
+	ps.times.record(reqtime)
+}
+
+// pushLines formats everything we've got in the protocol we're pushing with.
+// Latencies are in milliseconds. Graphite also gets a rate, StatsD works that
+// out from the counters itself.
+func pushLines(data map[string]*pushStats, ts time.Time) []string {
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var lines []string
+	add := func(name string, val interface{}, kind string) {
+		if pushProto == "statsd" {
+			lines = append(lines, fmt.Sprintf("%s:%v|%s", name, val, kind))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s %v %d", name, val, ts.Unix()))
+		}
+	}
+
+	for _, name := range names {
+		ps := data[name]
+		add(name+".requests", ps.count, "c")
+		add(name+".bytes", ps.bytes, "c")
+		add(name+".notfound", ps.notfound, "c")
+		add(name+".errors", ps.errors, "c")
+		if pushProto == "graphite" {
+			add(name+".rate", float64(ps.count)/float64(statusPeriod), "")
+		}
+
+		min, avg, max := calculateTimes(&ps.times)
+		add(name+".latency.min", min, "g")
+		add(name+".latency.avg", avg, "g")
+		add(name+".latency.max", max, "g")
+		for i, pval := range calculatePercentiles(&ps.times) {
+			pname := strings.Replace(fmt.Sprintf("p%g", percentiles[i]), ".",
+				"_", -1)
+			add(name+".latency."+pname, pval, "g")
+		}
+	}
+	return lines
+}
+
+// sendPush delivers the lines. StatsD gets as many UDP packets as it takes,
+// Graphite gets a fresh TCP connection each time.
+func sendPush(lines []string) error {
+	if pushProto == "statsd" {
+		conn, err := net.Dial("udp", pushAddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		var buf bytes.Buffer
+		for _, line := range lines {
+			if buf.Len() > 0 && buf.Len()+1+len(line) > pushMaxPacket {
+				if _, err = conn.Write(buf.Bytes()); err != nil {
+					return err
+				}
+				buf.Reset()
+			}
+			if buf.Len() > 0 {
+				buf.WriteByte('\n')
+			}
+			buf.WriteString(line)
+		}
+		if buf.Len() > 0 {
+			_, err = conn.Write(buf.Bytes())
+		}
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", pushAddr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = conn.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	return err
+}
+
+// pushMetrics sends off everything since the last push, as of the given time,
+// and starts afresh. If the push fails the numbers are dropped, same as StatsD
+// would do with a lost packet.
+func pushMetrics(ts time.Time) {
+	if pushProto == "" {
+		return
+	}
+
+	pushLock.Lock()
+	data := pushData
+	pushData = make(map[string]*pushStats)
+	pushLock.Unlock()
+
+	if len(data) == 0 {
+		return
+	}
+	if err := sendPush(pushLines(data, ts)); err != nil {
+		log.Printf("Failed to push metrics to %s: %s", pushAddr, err)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xb95/riak-sniffer/riakpb"
+)
+
+func TestPushName(t *testing.T) {
+	tests := map[string]string{
+		"":            "_",
+		"users":       "users",
+		"a.b":         "a_b",
+		"x:y|z":       "x_y_z",
+		"Ok-_9":       "Ok-_9",
+		"10.0.0.1:80": "10_0_0_1_80",
+		"caf\xc3\xa9": "caf_",
+	}
+	for val, want := range tests {
+		if got := pushName(val); got != want {
+			t.Errorf("pushName(%q) = %q, want %q", val, got, want)
+		}
+	}
+}
+
+// resetPush turns pushing back off once a test is done with it.
+func resetPush() {
+	pushProto, pushAddr, pushFormat, pushData = "", "", nil, nil
+}
+
+// readPackets reads StatsD packets until it has seen want lines.
+func readPackets(t *testing.T, conn net.PacketConn, want int) []string {
+	var packets []string
+	buf := make([]byte, 65536)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for lines := 0; lines < want; {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("got %d of %d lines: %s", lines, want, err)
+		}
+		packets = append(packets, string(buf[:n]))
+		lines += strings.Count(string(buf[:n]), "\n") + 1
+	}
+	return packets
+}
+
+func TestPushStatsd(t *testing.T) {
+	defer resetPush()
+	percentiles, statusPeriod = []float64{50, 99.9}, 10
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := startPush("statsd://"+conn.LocalAddr().String(), "riak.#m.#b"); err != nil {
+		t.Fatal(err)
+	}
+
+	rs := &riakSource{src: "10.0.0.1:5000", srcip: "10.0.0.1"}
+	recordPush(rs, &riakpb.Request{Method: "get", Bucket: []byte("a.b")},
+		&riakpb.Response{Outcome: "notfound"}, 10, 3000000)
+	recordPush(rs, &riakpb.Request{Method: "get", Bucket: []byte("a.b")},
+		&riakpb.Response{Outcome: "error"}, 20, 3000000)
+	recordPush(rs, &riakpb.Request{Method: "ping"},
+		&riakpb.Response{Outcome: "ok"}, 0, 3000000)
+
+	// 2 names, each with 4 counters, min/avg/max and 2 percentiles.
+	done := make(chan bool)
+	go func() { pushMetrics(time.Unix(1000, 0)); close(done) }()
+	packets := readPackets(t, conn, 18)
+	<-done
+
+	lines := make(map[string]bool)
+	for _, packet := range packets {
+		for _, line := range strings.Split(packet, "\n") {
+			lines[line] = true
+		}
+	}
+	for _, want := range []string{
+		"riak.get.a_b.requests:2|c",
+		"riak.get.a_b.bytes:30|c",
+		"riak.get.a_b.notfound:1|c",
+		"riak.get.a_b.errors:1|c",
+		"riak.get.a_b.latency.max:3|g",
+		"riak.get.a_b.latency.p50:3|g",
+		"riak.get.a_b.latency.p99_9:3|g",
+		"riak.ping._.requests:1|c",
+	} {
+		if !lines[want] {
+			t.Errorf("missing %q in %v", want, packets)
+		}
+	}
+	if len(lines) != 18 {
+		t.Errorf("got %d lines, want 18", len(lines))
+	}
+}
+
+func TestPushStatsdSplit(t *testing.T) {
+	defer resetPush()
+	percentiles, statusPeriod = []float64{50}, 10
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := startPush("statsd://"+conn.LocalAddr().String(), "riak.#b"); err != nil {
+		t.Fatal(err)
+	}
+
+	rs := &riakSource{src: "10.0.0.1:5000", srcip: "10.0.0.1"}
+	buckets := 50
+	for i := 0; i < buckets; i++ {
+		bucket := strings.Repeat(string('a'+byte(i%26)), i/26+1) + "bucket"
+		recordPush(rs, &riakpb.Request{Method: "get", Bucket: []byte(bucket)},
+			&riakpb.Response{Outcome: "ok"}, 10, 1000000)
+	}
+
+	want := buckets * 8
+	done := make(chan bool)
+	go func() { pushMetrics(time.Unix(1000, 0)); close(done) }()
+	packets := readPackets(t, conn, want)
+	<-done
+
+	if len(packets) < 2 {
+		t.Fatalf("expected the push to be split, got %d packet", len(packets))
+	}
+	lines := 0
+	for _, packet := range packets {
+		if len(packet) > pushMaxPacket {
+			t.Errorf("packet of %d bytes is over %d", len(packet), pushMaxPacket)
+		}
+		for _, line := range strings.Split(packet, "\n") {
+			if !strings.HasPrefix(line, "riak.") {
+				t.Errorf("line %q was split", line)
+			}
+			lines++
+		}
+	}
+	if lines != want {
+		t.Errorf("got %d lines, want %d", lines, want)
+	}
+}
+
+func TestPushGraphite(t *testing.T) {
+	defer resetPush()
+	percentiles, statusPeriod = []float64{99.9}, 10
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if err := startPush("graphite://"+listener.Addr().String(), "riak.#i.#m"); err != nil {
+		t.Fatal(err)
+	}
+
+	rs := &riakSource{src: "10.0.0.1:5000", srcip: "10.0.0.1"}
+	recordPush(rs, &riakpb.Request{Method: "put", Bucket: []byte("b")},
+		&riakpb.Response{Outcome: "ok"}, 100, 5000000)
+
+	done := make(chan bool)
+	go func() { pushMetrics(time.Unix(1000, 0)); close(done) }()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var lines []string
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	<-done
+
+	want := []string{
+		"riak.10_0_0_1.put.requests 1 1000",
+		"riak.10_0_0_1.put.bytes 100 1000",
+		"riak.10_0_0_1.put.notfound 0 1000",
+		"riak.10_0_0_1.put.errors 0 1000",
+		"riak.10_0_0_1.put.rate 0.1 1000",
+		"riak.10_0_0_1.put.latency.min 5 1000",
+		"riak.10_0_0_1.put.latency.avg 5 1000",
+		"riak.10_0_0_1.put.latency.max 5 1000",
+		"riak.10_0_0_1.put.latency.p99_9 5 1000",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got:\n%s\nwant:\n%s", strings.Join(lines, "\n"),
+			strings.Join(want, "\n"))
+	}
+}
+
+func TestPushNothing(t *testing.T) {
+	defer resetPush()
+
+	// Nothing recorded means nothing sent, so nowhere to send it is fine.
+	if err := startPush("statsd://127.0.0.1:1", "riak.#m"); err != nil {
+		t.Fatal(err)
+	}
+	pushMetrics(time.Unix(1000, 0))
+
+	for _, target := range []string{"localhost:8125", "udp://localhost:8125",
+		"statsd://localhost"} {
+		if err := startPush(target, "riak.#m"); err == nil {
+			t.Errorf("startPush(%q) didn't fail", target)
+		}
+	}
+}
@@ -4,8 +4,6 @@
  * A straightforward program for sniffing Riak proto-buffer streams and providing
  * diagnostic information on the realtime queries your database is handling.
  *
- * FIXME: this assumes IPv4.
- *
  * Taken from:
  *    https://github.com/xb95/riak-sniffer
  *
@@ -18,16 +16,16 @@
 package main
 
 import (
-	riak "github.com/xb95/riak-sniffer/proto"
-	"code.google.com/p/goprotobuf/proto"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/akrennmair/gopcap"
+	"github.com/xb95/riak-sniffer/flow"
+	"github.com/xb95/riak-sniffer/riakpb"
 	"log"
-	"math/rand"
-	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -42,10 +40,28 @@ const (
 	F_SOURCE
 	F_SOURCEIP
 	F_METHOD
+	F_OUTCOME
+	F_ERROR
+	F_R
+	F_W
+	F_PR
+	F_PW
+	F_DW
+	F_RW
+	F_HEAD
+	F_IFMODIFIED
+	F_RETURNBODY
+	F_RETURNHEAD
+	F_IFNOTMODIFIED
+	F_IFNONEMATCH
+	F_CONTENTTYPE
+	F_VALUESIZE
 )
 
 type packet struct {
 	request bool // request or response
+	lost    bool // data is missing between the last packet and this one
+	ts      time.Time
 	data    []byte
 }
 
@@ -56,67 +72,172 @@ type riakSource struct {
 	synced    bool
 	reqbuffer []byte
 	resbuffer []byte
-	reqSent   *time.Time
-	reqTimes  [100]uint64
-	qbytes    uint64
-	qdata     *queryData
-	qtext     string
 	ch        riakSourceChannel
+
+	// When we last lost (or never had) sync, to see how long it takes to get.
+	unsyncedSince time.Time
+
+	// Requests we're waiting on responses for, oldest first. Clients can
+	// pipeline requests and Riak answers them in order.
+	pending []*riakRequest
 }
 
-type riakMessage struct {
-	method string
-	bucket []byte
-	key    []byte
+// A request that has been sent and is waiting on a response.
+type riakRequest struct {
+	*riakpb.Transaction
+
+	// How it was counted: text is what it was aggregated as, filtered is
+	// whether the -F filter threw it out, counted is whether it was sent to
+	// the aggregator, and gen is the formatGen.
+	text      string
+	formatted bool
+	filtered  bool
+	counted   bool
+	gen       int
 }
 
 type queryData struct {
-	count uint64
-	bytes uint64
-	times [100]uint64
+	text     string
+	count    uint64
+	bytes    uint64
+	times    histogram
+	recent   window
+	notfound uint64
+	errors   uint64
+	values   map[int]string // of each F_XXXXXX token, for drilling down
+
+	// For bounded (top-K) tracking, see topk.go.
+	overcount uint64 // count inherited from an evicted query
+	index     int    // position in qheap
 }
 
-var start int64 = UnixNow()
+// All timing is done off of packet capture timestamps rather than the wall
+// clock, so that replaying a capture file gives the same numbers as sniffing
+// live would have. start is the first packet we saw, now is the latest.
+var start, now time.Time
 var qbuf map[string]*queryData = make(map[string]*queryData)
 var querycount int
-var chmap map[string]*riakSource = make(map[string]*riakSource)
+
+// How many requests a client can have outstanding before we decide we've
+// missed the responses.
+const maxPipeline = 1000
+
 var verbose bool = false
 var format []interface{}
+var formatNeedsResponse bool
 var port uint16
-var times [100]uint64
+var times, firsttimes, synctimes histogram
+var recent window
+var statusPeriod int64
+var percentiles []float64
+var wg sync.WaitGroup
 
 var stats struct {
 	packets struct {
 		rcvd      uint64
 		rcvd_sync uint64
 	}
-	desyncs uint64
-	streams uint64
-}
-
-func UnixNow() int64 {
-	return time.Now().Unix()
+	desyncs  uint64
+	syncs    uint64
+	gaps     uint64
+	streams  uint64
+	streamed struct {
+		responses uint64
+		items     uint64
+	}
+	pipeline struct {
+		requests uint64 // sent while others were still outstanding
+		maxdepth uint64
+	}
+	conns struct {
+		closed  uint64
+		expired uint64
+	}
 }
 
 func main() {
 	var lport *int = flag.Int("P", 8087, "Riak protocol buffer port")
 	var eth *string = flag.String("i", "eth0", "Interface to sniff")
+	var readfile *string = flag.String("r", "", "Read packets from a pcap file instead of sniffing")
 	var period *int = flag.Int("t", 10, "Seconds between outputting status")
 	var displaycount *int = flag.Int("d", 25, "Display this many queries in status updates")
 	var doverbose *bool = flag.Bool("v", false, "Print every query received (spammy)")
+	var dojson *bool = flag.Bool("j", false, "Output queries and status updates as JSON lines on stdout")
 	var formatstr *string = flag.String("f", "#b:#k", "Format for output aggregation")
+	var gapbytes *int = flag.Int("g", 1<<20, "Bytes to buffer per stream waiting for a missing TCP segment")
+	var gapsecs *float64 = flag.Float64("G", 5, "Seconds to wait for a missing TCP segment before skipping it")
+	var idle *int = flag.Int("e", 300, "Seconds of inactivity before a connection is expired")
+	var pctstr *string = flag.String("p", "50,90,99", "Latency percentiles to show in status updates")
+	var topk *int = flag.Int("k", 0, "Only keep track of this many of the most frequent queries (0 for no limit)")
+	var metricsaddr *string = flag.String("m", "", "Serve Prometheus metrics on this address, e.g. :9105")
+	var metricsmax *int = flag.Int("M", 500, "Maximum method/bucket series to export as metrics")
+	var pushtarget *string = flag.String("x", "", "Push metrics every period to statsd://host:port or graphite://host:port")
+	var pushtemplate *string = flag.String("X", "riak.#m.#b", "Template for pushed metric names")
+	var doui *bool = flag.Bool("u", false, "Show a live, interactive status table instead of status updates")
+	var slowms *float64 = flag.Float64("l", 0, "Only print requests slower than this many milliseconds (the slow log)")
+	var slowpath *string = flag.String("L", "", "Write the slow log to this file instead of stdout")
+	var slowmb *int = flag.Int("R", 100, "Rotate the slow log file when it reaches this many megabytes")
+	var slowkeep *int = flag.Int("K", 5, "Number of rotated slow log files to keep")
+	var sortstr *string = flag.String("s", "count", "Sort status updates by count, rate, bytes, min, avg, max, pNN, errors or notfound")
+	var filterstr *string = flag.String("F", "", "Only look at requests matching this filter, e.g. 'bucket = users and latency > 50ms'")
 	flag.Parse()
 
 	verbose = *doverbose
+	jsonOutput = *dojson
+	uiEnabled = *doui
+	if uiEnabled && (verbose || jsonOutput) {
+		log.Fatalf("The interactive view can't be used with -v or -j")
+	}
+	if *slowms > 0 && *slowpath == "" && uiEnabled {
+		log.Fatalf("The interactive view needs -L to write the slow log to")
+	}
+	if *period < 1 {
+		*period = 1
+	}
+	statusPeriod = int64(*period)
+	qbufCapacity = *topk
 	port = uint16(*lport)
 	parseFormat(*formatstr)
-	rand.Seed(time.Now().UnixNano())
+	parsePercentiles(*pctstr)
+	if err := parseSort(*sortstr); err != nil {
+		log.Fatalf("%s", err)
+	}
+	if strings.TrimSpace(*filterstr) != "" {
+		var err error
+		requestFilter, filterNeedsResponse, err = parseFilter(*filterstr)
+		if err != nil {
+			log.Fatalf("Bad filter: %s", err)
+		}
+	}
 
 	log.SetPrefix("")
 	log.SetFlags(0)
 
-	log.Printf("Initializing Riak sniffing on %s:%d...", *eth, port)
-	iface, err := pcap.Openlive(*eth, 65535, false, 0)
+	if *metricsaddr != "" {
+		startPrometheus(*metricsaddr, *metricsmax)
+	}
+	if *slowms > 0 {
+		err := startSlowLog(time.Duration(*slowms*float64(time.Millisecond)),
+			*slowpath, int64(*slowmb)<<20, *slowkeep)
+		if err != nil {
+			log.Fatalf("Failed to open slow log: %s", err)
+		}
+	}
+	if *pushtarget != "" {
+		if err := startPush(*pushtarget, *pushtemplate); err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
+
+	var iface *pcap.Pcap
+	var err error
+	if *readfile != "" {
+		log.Printf("Reading Riak packets from %s (port %d)...", *readfile, port)
+		iface, err = pcap.Openoffline(*readfile)
+	} else {
+		log.Printf("Initializing Riak sniffing on %s:%d...", *eth, port)
+		iface, err = pcap.Openlive(*eth, 65535, false, 0)
+	}
 	if iface == nil || err != nil {
 		if err == nil {
 			err = errors.New("unknown error")
@@ -128,50 +249,121 @@ func main() {
 		log.Fatalf("Failed to set port filter: %s", err)
 	}
 
-	last := UnixNow()
+	tracker, err := flow.NewTracker(iface.Datalink(), port, riakHandler{})
+	if err != nil {
+		log.Fatalf("Failed to set up link layer: %s", err)
+	}
+	tracker.MaxPending = *gapbytes
+	tracker.MaxPendingAge = time.Duration(*gapsecs * float64(time.Second))
+
+	startAggregator()
+	if uiEnabled {
+		startUI(*formatstr, *sortstr)
+	}
+
+	var last, lastExpire time.Time
 	var pkt *pcap.Packet = nil
 	var rv int32 = 0
 
+	// NextEx returns -1 on error and -2 when a capture file is exhausted,
+	// either way we're done reading packets.
 	for rv = 0; rv >= 0; {
 		for pkt, rv = iface.NextEx(); pkt != nil; pkt, rv = iface.NextEx() {
-			handlePacket(pkt)
+			if start.IsZero() {
+				start, last, lastExpire = pkt.Time, pkt.Time, pkt.Time
+			}
+			if pkt.Time.After(now) {
+				now = pkt.Time
+			}
+			// The filter should only be giving us our port. Anything else
+			// that won't decode isn't ours to worry about.
+			if tracker.Packet(pkt.Time, pkt.Data) == flow.ErrOtherPort {
+				fatalf("got packet for another port with filter on %d", port)
+			}
 
-			if !verbose && last <= UnixNow()-int64(*period) {
-				last = UnixNow()
-				handleStatusUpdate(*displaycount)
+			if now.Sub(lastExpire) >= 10*time.Second {
+				lastExpire = now
+				tracker.Expire(now.Add(-time.Duration(*idle) * time.Second))
+			}
+
+			if now.Sub(last) >= time.Duration(*period)*time.Second {
+				last = now
+				aggch <- tickEvent{start: start, now: now,
+					status: !quietStatus(), displaycount: *displaycount}
+				go pushMetrics(now)
 			}
 		}
 	}
+
+	// Let the listeners finish off whatever is still queued up for them so
+	// that the final report accounts for every packet we read.
+	tracker.CloseAll()
+	wg.Wait()
+	pushMetrics(now)
+
+	// The final report goes out even with -v or -l, it's the only summary
+	// you'll get of a capture file. The interactive view has its own table.
+	aggch <- tickEvent{start: start, now: now, status: !uiEnabled,
+		displaycount: *displaycount}
+	aggregate(func() {})
+	if uiEnabled {
+		// Leave the table up until the user quits, which exits.
+		log.Printf("No more packets, press q to quit")
+		select {}
+	}
 }
 
-func calculateTimes(timings *[100]uint64) (fmin, favg, fmax float64) {
-	var counts, total, min, max, avg uint64 = 0, 0, 0, 0, 0
-	has_min := false
-	for _, val := range *timings {
-		if val == 0 {
-			// Queries should never take 0 nanoseconds. We are using 0 as a
-			// trigger to mean 'uninitialized reading'.
+// quietStatus tells if status updates would get in the way of the output the
+// user asked for instead.
+func quietStatus() bool {
+	return verbose || uiEnabled || slowThreshold > 0 && slowPath == ""
+}
+
+func calculateTimes(timings *histogram) (fmin, favg, fmax float64) {
+	var avg uint64
+	if timings.count > 0 {
+		avg = timings.total / timings.count // integer division
+	}
+	return float64(timings.min) / 1000000, float64(avg) / 1000000,
+		float64(timings.max) / 1000000
+}
+
+// calculatePercentiles returns the percentiles the user asked for, in
+// milliseconds.
+func calculatePercentiles(timings *histogram) []float64 {
+	ret := make([]float64, len(percentiles))
+	for i, p := range percentiles {
+		ret[i] = float64(timings.percentile(p)) / 1000000
+	}
+	return ret
+}
+
+// parsePercentiles takes a comma separated list of percentiles, like
+// "50,99,99.9", and sets up the list we show in status updates.
+func parsePercentiles(pctstr string) {
+	for _, field := range strings.Split(pctstr, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
 			continue
 		}
-		if val < min || !has_min {
-			has_min = true
-			min = val
-		}
-		if val > max {
-			max = val
+		p, err := strconv.ParseFloat(field, 64)
+		if err != nil || p <= 0 || p > 100 {
+			log.Fatalf("Invalid percentile: %s", field)
 		}
-		counts++
-		total += val
+		percentiles = append(percentiles, p)
 	}
-	if counts > 0 {
-		avg = total / counts // integer division
-	}
-	return float64(min) / 1000000, float64(avg) / 1000000,
-		float64(max) / 1000000
 }
 
+// handleStatusUpdate prints a status update. It's only run by the aggregator.
 func handleStatusUpdate(displaycount int) {
-	elapsed := float64(UnixNow() - start)
+	elapsed := aggNow.Sub(aggStart).Seconds()
+	if elapsed < 1 {
+		elapsed = 1
+	}
+	if jsonOutput {
+		writeStatusJSON(elapsed)
+		return
+	}
 
 	// print status bar
 	log.Printf("\n")
@@ -180,35 +372,82 @@ func handleStatusUpdate(displaycount int) {
 		float64(querycount)/elapsed)
 	log.SetFlags(0)
 
+	// and what's been happening lately, like load averages
+	sec := aggNow.Unix()
+	interval := recent.sum(sec, statusPeriod)
+	rtext := fmt.Sprintf("%0.2f/s last %ds", windowRate(interval,
+		statusPeriod, elapsed), statusPeriod)
+	ltext := fmt.Sprintf("%0.2fms last %ds", windowLatency(interval),
+		statusPeriod)
+	for _, length := range windowLengths {
+		ws := recent.sum(sec, length)
+		rtext += fmt.Sprintf(" / %0.2f/s %dm", windowRate(ws, length, elapsed),
+			length/60)
+		ltext += fmt.Sprintf(" / %0.2fms %dm", windowLatency(ws), length/60)
+	}
+	log.Printf("rate: %s", rtext)
+	log.Printf("avg query time: %s", ltext)
+
 	rcvd, rcvd_sync := atomic.LoadUint64(&stats.packets.rcvd),
 		atomic.LoadUint64(&stats.packets.rcvd_sync)
-	desyncs, streams := atomic.LoadUint64(&stats.desyncs),
-		atomic.LoadUint64(&stats.streams)
-	log.Printf("%d packets (%0.2f%% on synchronized streams) / %d desyncs / %d streams",
-		rcvd, float64(rcvd_sync)/float64(rcvd)*100, desyncs, streams)
+	desyncs, gaps, streams := atomic.LoadUint64(&stats.desyncs),
+		atomic.LoadUint64(&stats.gaps), atomic.LoadUint64(&stats.streams)
+	log.Printf("%d packets (%0.2f%% on synchronized streams) / %d desyncs / %d gaps / %d streams",
+		rcvd, float64(rcvd_sync)/float64(rcvd)*100, desyncs, gaps, streams)
+	log.Printf("%d open / %d closed / %d expired connections", openConns(),
+		atomic.LoadUint64(&stats.conns.closed),
+		atomic.LoadUint64(&stats.conns.expired))
+	smin, savg, smax := calculateTimes(&synctimes)
+	log.Printf("%d syncs, %0.2fms min / %0.2fms avg / %0.2fms max time to sync",
+		atomic.LoadUint64(&stats.syncs), smin, savg, smax)
 
 	// global timing values
 	gmin, gavg, gmax := calculateTimes(&times)
-	log.Printf("%0.2fms min / %0.2fms avg / %0.2fms max query time",
-		gmin, gavg, gmax)
+	gtext := fmt.Sprintf("%0.2fms min / %0.2fms avg / %0.2fms max", gmin,
+		gavg, gmax)
+	for i, pval := range calculatePercentiles(&times) {
+		gtext += fmt.Sprintf(" / %0.2fms p%g", pval, percentiles[i])
+	}
+	log.Printf("%s query time", gtext)
+	if responses := atomic.LoadUint64(&stats.streamed.responses); responses > 0 {
+		_, favg, _ := calculateTimes(&firsttimes)
+		log.Printf("%d streamed responses / %d items / %0.2fms avg to first frame",
+			responses, atomic.LoadUint64(&stats.streamed.items), favg)
+	}
+	if pipelined := atomic.LoadUint64(&stats.pipeline.requests); pipelined > 0 {
+		log.Printf("%d pipelined requests / %d max depth", pipelined,
+			atomic.LoadUint64(&stats.pipeline.maxdepth))
+	}
+	if qbufCapacity > 0 {
+		log.Printf("tracking top %d of %d queries, counts may be up to %d too high",
+			len(qbuf), qbufCapacity, countErrorBound())
+	}
 	log.Printf(" ")
 
-	// we cheat so badly here...
-	var tmp sort.StringSlice = make([]string, 0, len(qbuf))
-	for q, c := range qbuf {
-		qmin, qavg, qmax := calculateTimes(&c.times)
-		tmp = append(tmp, fmt.Sprintf("%6d  %6.2f/s  %6.2f %6.2f %6.2f %8db  %s",
-			c.count, float64(c.count)/elapsed, qmin, qavg, qmax, c.bytes, q))
+	log.Print(formatStatusHeader())
+	rows := getStatusRows(elapsed, sec)
+	if len(rows) < displaycount {
+		displaycount = len(rows)
 	}
-	sort.Sort(tmp)
-
-	// now print top to bottom, since our sorted list is sorted backwards
-	// from what we want
-	if len(tmp) < displaycount {
-		displaycount = len(tmp)
+	for _, c := range rows[:displaycount] {
+		log.Print(formatStatusRow(c))
 	}
-	for i := 1; i <= displaycount; i++ {
-		log.Printf(tmp[len(tmp)-i])
+}
+
+// openConns returns how many connections are open. The flow tracker belongs to
+// the capture loop, so this works it out from the counters instead.
+func openConns() uint64 {
+	return atomic.LoadUint64(&stats.streams) -
+		atomic.LoadUint64(&stats.conns.closed) -
+		atomic.LoadUint64(&stats.conns.expired)
+}
+
+// storeMax atomically sets *addr to val if val is bigger.
+func storeMax(addr *uint64, val uint64) {
+	for old := atomic.LoadUint64(addr); val > old; old = atomic.LoadUint64(addr) {
+		if atomic.CompareAndSwapUint64(addr, old, val) {
+			return
+		}
 	}
 }
 
@@ -228,8 +467,8 @@ func safe_output(inp []byte) string {
 // Listens on a channel for bytes. This is how we get data in from the various
 // clients that are talking to Riak.
 func riakSourceListener(rs *riakSource) {
-	for {
-		pkt := <-rs.ch
+	defer wg.Done()
+	for pkt := range rs.ch {
 		//		log.Printf("[%s] request=%t, got %d bytes", rs.src, pkt.request,
 		//			len(pkt.data))
 
@@ -238,264 +477,306 @@ func riakSourceListener(rs *riakSource) {
 			atomic.AddUint64(&stats.packets.rcvd_sync, 1)
 		}
 
-		var ptype int = -1
-		var pdata []byte
+		if rs.unsyncedSince.IsZero() {
+			rs.unsyncedSince = pkt.ts
+		}
 
-		if pkt.request {
-			// If we still have response buffer, we're in some weird state and
-			// didn't successfully process the response.
-			if rs.resbuffer != nil {
-				//				log.Printf("[%s] possibly pipelined request? %d bytes",
-				//					rs.src, len(rs.resbuffer))
+		// The reassembler had to give up on some missing data, so whatever
+		// we have buffered can't be trusted. Start over and wait for a clean
+		// request to resync on.
+		if pkt.lost {
+			atomic.AddUint64(&stats.gaps, 1)
+			if rs.synced {
 				atomic.AddUint64(&stats.desyncs, 1)
-				rs.resbuffer = nil
-				rs.synced = false
 			}
+			rs.desync(pkt.ts)
+		}
+
+		var buf *[]byte
+		if pkt.request {
 			rs.reqbuffer = append(rs.reqbuffer, pkt.data...)
-			ptype, pdata = carvePacket(&rs.reqbuffer)
+			buf = &rs.reqbuffer
 		} else {
 			rs.resbuffer = append(rs.resbuffer, pkt.data...)
-			ptype, pdata = carvePacket(&rs.resbuffer)
+			buf = &rs.resbuffer
 		}
 
-		// The synchronization logic: if we're not presently, then we want to
-		// keep going until we are capable of carving off of a request.
-		if !rs.synced {
-			if !(pkt.request && ptype == 9) {
-				rs.reqbuffer, rs.resbuffer = nil, nil
-				continue
-			}
+		// A packet can hold any number of frames (and streaming responses
+		// often do), so keep going until there's nothing left to carve.
+		for {
+			// The synchronization logic: if we're not presently, then we want
+			// to keep going until we are capable of carving off of a request.
+			// Responses are useless to us until then.
+			if !rs.synced {
+				if !pkt.request {
+					rs.resbuffer = nil
+					break
+				}
 
-			// It's a GET request, so try to pull a protobuf out of this as a
-			// final test to make sure we're solid.
-			err := proto.Unmarshal(pdata, &riak.RpbGetReq{})
-			if err != nil {
-				rs.reqbuffer, rs.resbuffer = nil, nil
-				continue
+				// If this doesn't look like the start of a request, throw it
+				// away. If it does but we don't have all of it, wait.
+				valid, complete := riakpb.CheckRequest(*buf)
+				if !valid {
+					rs.reqbuffer, rs.resbuffer = nil, nil
+					break
+				}
+				if !complete {
+					break
+				}
+
+				rs.synced = true
+				synctime := uint64(pkt.ts.Sub(rs.unsyncedSince).Nanoseconds())
+				aggch <- syncEvent{synctime}
+				atomic.AddUint64(&stats.syncs, 1)
+				//				log.Printf("[%s] synced after %0.2fms", rs.src,
+				//					float64(synctime)/1000000)
 			}
 
-			rs.synced = true
-		}
+			ptype, pdata, err := riakpb.Carve(buf)
 
-		// No (full) packet detected yet. Continue on our way.
-		if ptype == -1 {
-			continue
-		}
-		plen := uint64(len(pdata))
-
-		// If this is a response then we want to record the timing and
-		// store it with this channel so we can keep track of that.
-		var reqtime uint64
-		if !pkt.request {
-			if rs.reqSent == nil {
-				continue
-			}
-			reqtime = uint64(time.Since(*rs.reqSent).Nanoseconds())
-
-			// We keep track of per-source, global, and per-query timings.
-			randn := rand.Intn(100)
-			rs.reqTimes[randn] = reqtime
-			times[randn] = reqtime
-			if rs.qdata != nil {
-				// This should never fail but it has. Probably because of a
-				// race condition I need to suss out, or sharing between
-				// two different goroutines. :(
-				rs.qdata.times[randn] = reqtime
-				rs.qdata.bytes += plen
+			// A nonsense length means we've lost our place in the stream,
+			// we'll have to find it again.
+			if err != nil {
+				atomic.AddUint64(&stats.desyncs, 1)
+				rs.desync(pkt.ts)
+				break
 			}
-			rs.reqSent = nil
 
-			// If we're in verbose mode, just dump statistics from this one.
-			if verbose {
-				log.Printf("%s %d %d %0.2f\n", rs.qtext, rs.qbytes, plen,
-					float64(reqtime)/1000000)
+			// No (full) packet detected yet. Continue on our way.
+			if ptype == -1 {
+				break
 			}
 
-			continue
-		}
-
-		// This is for sure a request, so let's count it as one.
-		if rs.reqSent != nil {
-			//			log.Printf("[%s] ...sending two requests without a response?",
-			//				rs.src)
-		}
-		tnow := time.Now()
-		rs.reqSent = &tnow
-
-		// Now see if we can possibly parse out the proto from this
-		// packet or if we get gibberish.
-		msg, err := getProto(ptype, pdata)
-		if err != nil {
-			log.Printf("[%s] failed to parse proto: %s", rs.src, err)
-			continue
-		}
-		if msg == nil {
-			log.Printf("[%s] didn't parse message: type=%d", rs.src, ptype)
-			continue
-		}
-
-		// Convert this request into whatever format the user wants.
-		querycount++
-		var text string
-		for _, item := range format {
-			switch item.(type) {
-			case int:
-				switch item.(int) {
-				case F_NONE:
-					log.Fatalf("F_NONE in format string")
-				case F_KEY:
-					text += safe_output((*msg).key)
-				case F_BUCKET:
-					text += string((*msg).bucket)
-				case F_SOURCE:
-					text += rs.src
-				case F_SOURCEIP:
-					text += rs.srcip
-				case F_METHOD:
-					text += (*msg).method
-				default:
-					log.Fatalf("Unknown F_XXXXXX int in format string")
-				}
-			case string:
-				text += item.(string)
-			default:
-				log.Fatalf("Unknown type in format string")
+			if pkt.request {
+				handleRequest(rs, pkt.ts, ptype, pdata)
+			} else {
+				handleResponse(rs, pkt.ts, ptype, pdata)
 			}
 		}
-		qdata, ok := qbuf[text]
-		if !ok {
-			qdata = &queryData{}
-			qbuf[text] = qdata
-		}
-		qdata.count++
-		qdata.bytes += plen
-		rs.qtext, rs.qdata, rs.qbytes = text, qdata, plen
 	}
 }
 
-// carvePacket tries to pull a packet out of a slice of bytes. If so, it removes
-// those bytes from the slice.
-func carvePacket(buf *[]byte) (int, []byte) {
-	datalen := uint32(len(*buf))
-	if datalen < 5 {
-		return -1, nil
-	}
+// desync throws away everything we know about the state of the connection,
+// we'll have to wait for another request to synchronize on.
+func (rs *riakSource) desync(ts time.Time) {
+	rs.reqbuffer, rs.resbuffer, rs.pending = nil, nil, nil
+	rs.synced, rs.unsyncedSince = false, ts
+}
 
-	size := uint32((*buf)[0])<<24 + uint32((*buf)[1])<<16 + uint32((*buf)[2])<<8 +
-		uint32((*buf)[3])
-	if datalen < size+4 {
-		return -1, nil
+// handleResponse deals with one response frame, which belongs to the oldest
+// request we're waiting on. Once it's the last frame of the response we
+// record the timing and store it with this source so we can keep track of
+// that.
+func handleResponse(rs *riakSource, ts time.Time, ptype int, pdata []byte) {
+	if len(rs.pending) == 0 {
+		return
 	}
-
-	end := size + 4
-	ptype := int((*buf)[4])
-	data := (*buf)[5 : size+4]
-	if end >= datalen {
-		*buf = nil
-	} else {
-		*buf = (*buf)[end:]
+	req := rs.pending[0]
+
+	// Responses are always the request code plus one, or an error. If not,
+	// we've lost track of which response goes with which request.
+	done, err := req.AddResponse(ts, ptype, pdata)
+	if err == riakpb.ErrUnexpectedResponse {
+		//		log.Printf("[%s] response %d to request %d", rs.src, ptype,
+		//			req.Code)
+		atomic.AddUint64(&stats.desyncs, 1)
+		rs.desync(ts)
+		return
+	}
+	if err != nil {
+		log.Printf("[%s] failed to parse response: %s", rs.src, err)
 	}
 
-	//	log.Printf("datalen=%d size=%d end=%d ptype=%d data=%d buf=%d",
-	//		datalen, size, end, ptype, len(data), len(*buf))
+	// Streaming responses keep going until the frame that says it's done.
+	if !done {
+		return
+	}
+	rs.pending = rs.pending[1:]
 
-	return ptype, data
-}
+	res := req.Response
+	plen, reqtime := req.ResponseBytes, uint64(req.Latency().Nanoseconds())
+	firsttime := uint64(req.FirstFrameLatency().Nanoseconds())
+	streamed := req.Streamed()
 
-// Given a set of bytes and a type, return a protocol buffer object.
-func getProto(msgtype int, data []byte) (*riakMessage, error) {
-	var ret *riakMessage = nil
+	// If the format or filter has anything from the response in it, we
+	// couldn't count the request until now.
+	if req.Request != nil && !req.formatted {
+		countRequest(rs, req, res)
+	}
 
-	switch msgtype {
-	case 0x09:
-		obj := &riak.RpbGetReq{}
-		err := proto.Unmarshal(data, obj)
-		if err != nil {
-			return nil, err
-		}
+	// Anything the filter threw out doesn't count towards anything, and if we
+	// couldn't parse the request we can't tell whether it would have.
+	if req.filtered || req.Request == nil && requestFilter != nil {
+		return
+	}
 
-		ret = &riakMessage{method: "get", bucket: []byte(obj.Bucket),
-			key: []byte(obj.Key)}
-	case 0x0a:
-		// get response
-	case 0x0b:
-		obj := &riak.RpbPutReq{}
-		err := proto.Unmarshal(data, obj)
-		if err != nil {
-			return nil, err
-		}
+	// The timings themselves belong to the aggregator.
+	gen := -1
+	if req.counted {
+		gen = req.gen
+	}
+	aggch <- responseEvent{text: req.text, gen: gen, bytes: plen,
+		reqtime: reqtime, firsttime: firsttime, streamed: streamed,
+		outcome: res.Outcome, ts: ts}
+	if streamed {
+		atomic.AddUint64(&stats.streamed.responses, 1)
+		atomic.AddUint64(&stats.streamed.items, req.Items)
+	}
 
-		ret = &riakMessage{method: "put", bucket: []byte(obj.Bucket),
-			key: []byte(obj.Key)}
-	case 0x0c:
-		// put response
+	if req.Request != nil {
+		recordPrometheus(req.Request, res, reqtime)
+		recordPush(rs, req.Request, res, plen, reqtime)
+		writeSlowLog(rs, req, res, ts, plen, reqtime, firsttime)
 	}
 
-	return ret, nil
+	// If we're in verbose mode, just dump statistics from this one.
+	if verbose && req.Request != nil {
+		if jsonOutput {
+			writeRequestJSON(rs, req, res, ts, plen, reqtime, firsttime)
+		} else if streamed {
+			log.Printf("%s %d %d %0.2f %s %d %0.2f\n", req.text,
+				req.RequestBytes, plen, float64(reqtime)/1000000, res.Outcome,
+				req.Items, float64(firsttime)/1000000)
+		} else {
+			log.Printf("%s %d %d %0.2f %s\n", req.text, req.RequestBytes,
+				plen, float64(reqtime)/1000000, res.Outcome)
+		}
+	}
 }
 
-// Given a source ("ip:port" string), return a channel that can be used to send
-// payload bytes to. If that channel doesn't exist, it sets one up.
-func getChannel(src string) riakSourceChannel {
-	rs, ok := chmap[src]
-	if !ok {
-		srcip := src[0:strings.Index(src, ":")]
-		rs = &riakSource{src: src, srcip: srcip, synced: false, ch: make(riakSourceChannel, 10)}
-		atomic.AddUint64(&stats.streams, 1)
-		go riakSourceListener(rs)
-		chmap[src] = rs
+// handleRequest deals with one request frame, adding it to the end of the
+// list of requests waiting on a response.
+func handleRequest(rs *riakSource, ts time.Time, ptype int, pdata []byte) {
+	// If the responses aren't coming (we're only seeing one direction of the
+	// traffic?) don't let the queue grow forever.
+	if len(rs.pending) >= maxPipeline {
+		atomic.AddUint64(&stats.desyncs, 1)
+		rs.pending = nil
 	}
-	return rs.ch
-}
 
-// extract the data... we have to figure out where it is, which means extracting data
-// from the various headers until we get the location we want.  this is crude, but
-// functional and it should be fast.
-func handlePacket(pkt *pcap.Packet) {
-	// Ethernet frame has 14 bytes of stuff to ignore, so we start our root position here
-	var pos byte = 14
+	// This is for sure a request, so let's count it as one. We have to keep
+	// it in the queue even if we can't parse it, or the responses won't line
+	// up with the right requests.
+	txn, err := riakpb.NewTransaction(ts, ptype, pdata)
+	req := &riakRequest{Transaction: txn}
+	rs.pending = append(rs.pending, req)
+	if depth := uint64(len(rs.pending)); depth > 1 {
+		atomic.AddUint64(&stats.pipeline.requests, 1)
+		storeMax(&stats.pipeline.maxdepth, depth)
+	}
 
-	// Grab the src IP address of this packet from the IP header.
-	srcIP := pkt.Data[pos+12 : pos+16]
-	dstIP := pkt.Data[pos+16 : pos+20]
+	// See if we could parse out the proto from this packet or if we got
+	// gibberish.
+	if err == riakpb.ErrNotRequest {
+		log.Printf("[%s] didn't parse message: type=%d", rs.src, ptype)
+		return
+	}
+	if err != nil {
+		log.Printf("[%s] failed to parse proto: %s", rs.src, err)
+		return
+	}
 
-	// The IP frame has the header length in bits 4-7 of byte 0 (relative).
-	pos += pkt.Data[pos] & 0x0F * 4
+	// Convert this request into whatever format the user wants, unless
+	// we have to wait for the response to do that.
+	countRequest(rs, req, nil)
+}
 
-	// Grab the source port from the TCP header.
-	srcPort := uint16(pkt.Data[pos])<<8 + uint16(pkt.Data[pos+1])
-	dstPort := uint16(pkt.Data[pos+2])<<8 + uint16(pkt.Data[pos+3])
+// formatQuery builds the aggregation key for a request (and its response, if
+// we have it) using the format the user asked for.
+func formatQuery(rs *riakSource, msg *riakpb.Request, res *riakpb.Response) string {
+	var text string
+	for _, item := range format {
+		switch item.(type) {
+		case int:
+			text += formatToken(item.(int), rs, msg, res)
+		case string:
+			text += item.(string)
+		default:
+			fatalf("Unknown type in format string")
+		}
+	}
+	return text
+}
 
-	// The TCP frame has the data offset in bits 4-7 of byte 12 (relative).
-	pos += byte(pkt.Data[pos+12]) >> 4 * 4
+// formatToken returns the value of one of the F_XXXXXX tokens for a request.
+// Tokens that need the response are empty if we don't have it.
+func formatToken(token int, rs *riakSource, msg *riakpb.Request,
+	res *riakpb.Response) string {
+	def, ok := formatTokens[token]
+	if !ok {
+		fatalf("Unknown F_XXXXXX int in format string")
+	}
+	if def.needsResponse && res == nil {
+		return ""
+	}
+	return def.value(rs, msg, res)
+}
 
-	// If this is a 0-length payload, do nothing. (Any way to change our filter
-	// to only dump packets with data?)
-	if len(pkt.Data[pos:]) <= 0 {
+// countRequest formats a request and sends it off to be counted, unless it
+// doesn't match the -F filter or the UI has drilled down to requests it
+// doesn't match. If the format or filter needs the response and we don't have
+// it yet, this does nothing until we do.
+func countRequest(rs *riakSource, req *riakRequest, res *riakpb.Response) {
+	formatLock.RLock()
+	if (formatNeedsResponse || filterNeedsResponse) && res == nil {
+		formatLock.RUnlock()
 		return
 	}
+	req.text, req.formatted = formatQuery(rs, req.Request, res), true
+	req.filtered = !requestMatches(rs, req, res)
+	req.counted = !req.filtered && filterMatches(rs, req.Request, res)
+	req.gen = formatGen
+	var values map[int]string
+	if req.counted && uiEnabled {
+		values = make(map[int]string)
+		for _, item := range format {
+			if token, ok := item.(int); ok {
+				values[token] = formatToken(token, rs, req.Request, res)
+			}
+		}
+	}
+	formatLock.RUnlock()
 
-	// This is either an inbound or outbound packet. Determine by seeing which
-	// end contains our port. Either way, we want to put this on the channel of
-	// the remote end.
-	var src string
-	var request bool = false
-	if srcPort == port {
-		src = fmt.Sprintf("%d.%d.%d.%d:%d", dstIP[0], dstIP[1], dstIP[2],
-			dstIP[3], dstPort)
-		//		log.Printf("response to %s", src)
-	} else if dstPort == port {
-		src = fmt.Sprintf("%d.%d.%d.%d:%d", srcIP[0], srcIP[1], srcIP[2],
-			srcIP[3], srcPort)
-		request = true
-		//		log.Printf("request from %s", src)
-	} else {
-		log.Fatalf("got packet src = %d, dst = %d", srcPort, dstPort)
+	// Don't hold the lock while sending, the aggregator might be waiting on
+	// it to change the format.
+	if req.counted {
+		aggch <- requestEvent{text: req.text, values: values, gen: req.gen,
+			bytes: req.RequestBytes, ts: req.Sent}
 	}
+}
 
-	// Now we have the source and payload information, we can pass this off to
-	// somebody who is better equipped to process it.
-	getChannel(src) <- &packet{request: request, data: pkt.Data[pos:]}
+// riakHandler plugs the listeners into the flow tracker. Each connection gets
+// a riakSource and a listener, and we send it the bytes as they come in.
+type riakHandler struct{}
+
+func (riakHandler) Open(f *flow.Flow) {
+	rs := &riakSource{src: f.Client, srcip: f.ClientIP, synced: false,
+		ch: make(riakSourceChannel, 10)}
+	atomic.AddUint64(&stats.streams, 1)
+	wg.Add(1)
+	go riakSourceListener(rs)
+	f.Context = rs
+}
+
+func (riakHandler) Data(f *flow.Flow, dir flow.Direction, ts time.Time,
+	data []byte, lost bool) {
+	// pcap gives us a fresh buffer for every packet, so there's no need to
+	// copy this before handing it off.
+	rs := f.Context.(*riakSource)
+	rs.ch <- &packet{request: dir == flow.ToServer, lost: lost, ts: ts,
+		data: data}
+}
+
+// Close tears down a connection we're done with. The listener will exit once
+// it has worked through anything still on its channel.
+func (riakHandler) Close(f *flow.Flow, reason flow.CloseReason) {
+	close(f.Context.(*riakSource).ch)
+	switch reason {
+	case flow.Finished, flow.Reused:
+		atomic.AddUint64(&stats.conns.closed, 1)
+	case flow.Expired:
+		atomic.AddUint64(&stats.conns.expired, 1)
+	}
 }
 
 // parseFormat takes a string and parses it out into the given format slice
@@ -506,11 +787,20 @@ func parseFormat(formatstr string) {
 	if formatstr == "" {
 		formatstr = "#b:#k"
 	}
+	format, formatNeedsResponse = compileFormat(formatstr)
+}
 
+// compileFormat turns a format string into the list of literal strings and
+// F_XXXXXX tokens that formatQuery walks. It also returns whether any of the
+// tokens need the response to be known. Tokens are #x for the ones with a
+// short name, or #{name} for any of them; see tokens.go.
+func compileFormat(formatstr string) (format []interface{}, needsResponse bool) {
 	is_special := false
 	curstr := ""
 	do_append := F_NONE
-	for _, char := range formatstr {
+	chars := []rune(formatstr)
+	for i := 0; i < len(chars); i++ {
+		char := chars[i]
 		if char == '#' {
 			if is_special {
 				curstr += string(char)
@@ -522,19 +812,21 @@ func parseFormat(formatstr string) {
 		}
 
 		if is_special {
-			switch strings.ToLower(string(char)) {
-			case "k":
-				do_append = F_KEY
-			case "b":
-				do_append = F_BUCKET
-			case "s":
-				do_append = F_SOURCE
-			case "i":
-				do_append = F_SOURCEIP
-			case "m":
-				do_append = F_METHOD
-			default:
+			if char == '{' {
+				end := strings.IndexRune(string(chars[i:]), '}')
+				if end >= 0 {
+					name := string(chars[i:])[1:end]
+					if do_append = lookupToken(name, true); do_append != F_NONE {
+						i += len([]rune(name)) + 1
+					}
+				}
+			} else {
+				do_append = lookupToken(string(char), false)
+			}
+			if do_append == F_NONE {
 				curstr += "#" + string(char)
+			} else if formatTokens[do_append].needsResponse {
+				needsResponse = true
 			}
 			is_special = false
 		} else {
@@ -554,4 +846,5 @@ func parseFormat(formatstr string) {
 	if curstr != "" {
 		format = append(format, curstr)
 	}
+	return format, needsResponse
 }
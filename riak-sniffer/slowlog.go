@@ -0,0 +1,170 @@
+/*
+ * slowlog.go
+ *
+ * The slow query log: every request that took longer than a threshold, one
+ * per line with everything we know about it, and nothing else. Verbose mode
+ * is too noisy to find the outliers in, and the status updates average them
+ * away.
+ *
+ * Entries go to stdout, or to a file that's rotated once it gets big.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/xb95/riak-sniffer/riakpb"
+)
+
+// Requests slower than this are logged, in nanoseconds. 0 if we aren't.
+var slowThreshold uint64
+
+var slowLock sync.Mutex
+var slowFile *os.File
+var slowPath string // empty if we're logging to stdout
+var slowSize int64  // of the current file
+var slowMaxSize int64
+var slowKeep int
+
+// startSlowLog turns on the slow log. If path is empty, entries are written to
+// stdout, otherwise path is rotated when it reaches maxSize bytes, keeping the
+// last keep files as path.1 (newest) to path.N.
+func startSlowLog(threshold time.Duration, path string, maxSize int64,
+	keep int) error {
+	slowThreshold = uint64(threshold.Nanoseconds())
+	if slowThreshold == 0 {
+		slowThreshold = 1
+	}
+	if path == "" {
+		return nil
+	}
+
+	slowPath, slowMaxSize, slowKeep = path, maxSize, keep
+	return openSlowLog()
+}
+
+// openSlowLog opens the slow log file for appending.
+func openSlowLog() error {
+	file, err := os.OpenFile(slowPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	slowFile, slowSize = file, info.Size()
+	return nil
+}
+
+// rotateSlowLog moves the current file out of the way, shuffling the older
+// ones along and dropping the oldest, and starts a new one.
+func rotateSlowLog() error {
+	slowFile.Close()
+	slowFile = nil
+
+	if slowKeep <= 0 {
+		os.Remove(slowPath)
+	} else {
+		for i := slowKeep - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", slowPath, i),
+				fmt.Sprintf("%s.%d", slowPath, i+1))
+		}
+		if err := os.Rename(slowPath, slowPath+".1"); err != nil {
+			return err
+		}
+	}
+	return openSlowLog()
+}
+
+// dash stands in for empty fields, so the columns still line up.
+func dash(val string) string {
+	if val == "" {
+		return "-"
+	}
+	return val
+}
+
+// quorumText lists the quorum values the client asked for, like "r=2 pr=1".
+func quorumText(msg *riakpb.Request) string {
+	var text string
+	add := func(name string, val *uint32) {
+		if val != nil {
+			text += fmt.Sprintf(" %s=%s", name, riakpb.QuorumName(val))
+		}
+	}
+	add("r", msg.R)
+	add("w", msg.W)
+	add("pr", msg.PR)
+	add("pw", msg.PW)
+	add("dw", msg.DW)
+	add("rw", msg.RW)
+	if msg.Vclock {
+		text += " vclock"
+	}
+	if text == "" {
+		return "-"
+	}
+	return text[1:]
+}
+
+// writeSlowLog logs a request if it was slow enough. With -j, entries are the
+// same JSON objects that verbose mode writes.
+func writeSlowLog(rs *riakSource, req *riakRequest, res *riakpb.Response,
+	ts time.Time, plen, reqtime, firsttime uint64) {
+	if slowThreshold == 0 || reqtime < slowThreshold {
+		return
+	}
+
+	var line string
+	if jsonOutput {
+		obj := getRequestJSON(rs, req, res, ts, plen, reqtime, firsttime)
+		if slowPath == "" {
+			writeJSON(obj)
+			return
+		}
+		buf, err := json.Marshal(obj)
+		if err != nil {
+			fatalf("Failed to write JSON: %s", err)
+		}
+		line = string(buf)
+	} else {
+		msg := req.Request
+		line = fmt.Sprintf("%s %s %s %s %s %s %db %db %db %0.2fms %s",
+			ts.Format("2006-01-02 15:04:05.000000"), rs.src, msg.Method,
+			dash(safe_output(msg.Bucket)), dash(safe_output(msg.Key)),
+			quorumText(msg), req.RequestBytes, plen, res.ValueSize,
+			float64(reqtime)/1000000, res.Outcome)
+		if len(res.ErrMsg) > 0 {
+			line += " " + safe_output(res.ErrMsg)
+		}
+		if slowPath == "" {
+			log.Print(line)
+			return
+		}
+	}
+
+	slowLock.Lock()
+	defer slowLock.Unlock()
+
+	if slowMaxSize > 0 && slowSize > 0 &&
+		slowSize+int64(len(line))+1 > slowMaxSize {
+		if err := rotateSlowLog(); err != nil {
+			fatalf("Failed to rotate slow log: %s", err)
+		}
+	}
+	n, err := fmt.Fprintln(slowFile, line)
+	if err != nil {
+		fatalf("Failed to write slow log: %s", err)
+	}
+	slowSize += int64(n)
+}
@@ -0,0 +1,150 @@
+/*
+ * status.go
+ *
+ * Turns the aggregated query data into the rows of the status table, and
+ * sorts them by whatever column the user cares about.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// One row of the status table, with everything already worked out.
+type statusRow struct {
+	query    string
+	data     *queryData
+	count    uint64
+	rate     float64   // since we started
+	last     float64   // over the last status interval
+	windows  []float64 // over each of windowLengths
+	lastavg  float64   // average latency over the last status interval
+	avgs     []float64 // and over each of windowLengths
+	min      float64   // milliseconds
+	avg      float64
+	max      float64
+	pcts     []float64 // the percentiles the user asked for
+	bytes    uint64
+	notfound float64 // percentage of requests
+	errors   float64
+}
+
+// A sortKey pulls the number we sort on out of a row. Bigger goes first.
+type sortKey func(row *statusRow) float64
+
+var sortBy sortKey
+
+// parseSort sets up the sort order from its name: count, rate, bytes, min,
+// avg, max, errors, notfound, or pNN for any percentile.
+func parseSort(name string) error {
+	name = strings.ToLower(strings.TrimSpace(name))
+	switch name {
+	case "", "count":
+		sortBy = func(row *statusRow) float64 { return float64(row.count) }
+	case "rate":
+		sortBy = func(row *statusRow) float64 { return row.last }
+	case "bytes":
+		sortBy = func(row *statusRow) float64 { return float64(row.bytes) }
+	case "min":
+		sortBy = func(row *statusRow) float64 { return row.min }
+	case "avg":
+		sortBy = func(row *statusRow) float64 { return row.avg }
+	case "max":
+		sortBy = func(row *statusRow) float64 { return row.max }
+	case "errors":
+		sortBy = func(row *statusRow) float64 { return float64(row.data.errors) }
+	case "notfound":
+		sortBy = func(row *statusRow) float64 { return float64(row.data.notfound) }
+	default:
+		if !strings.HasPrefix(name, "p") {
+			return fmt.Errorf("unknown sort order %s", name)
+		}
+		p, err := strconv.ParseFloat(name[1:], 64)
+		if err != nil || p <= 0 || p > 100 {
+			return fmt.Errorf("unknown sort order %s", name)
+		}
+		sortBy = func(row *statusRow) float64 {
+			return float64(row.data.times.percentile(p))
+		}
+	}
+	return nil
+}
+
+// getStatusRows works out a row for every query we've aggregated, sorted by
+// the user's sort order. elapsed is how long we've been running and sec is
+// the second we're reporting as of.
+func getStatusRows(elapsed float64, sec int64) []*statusRow {
+	rows := make([]*statusRow, 0, len(qbuf))
+	for q, c := range qbuf {
+		row := &statusRow{query: q, data: c, count: c.count, bytes: c.bytes,
+			rate: float64(c.count) / elapsed}
+		interval := c.recent.sum(sec, statusPeriod)
+		row.last = windowRate(interval, statusPeriod, elapsed)
+		row.lastavg = windowLatency(interval)
+		for _, length := range windowLengths {
+			ws := c.recent.sum(sec, length)
+			row.windows = append(row.windows, windowRate(ws, length, elapsed))
+			row.avgs = append(row.avgs, windowLatency(ws))
+		}
+		row.min, row.avg, row.max = calculateTimes(&c.times)
+		row.pcts = calculatePercentiles(&c.times)
+		if c.count > 0 {
+			row.notfound = float64(c.notfound) / float64(c.count) * 100
+			row.errors = float64(c.errors) / float64(c.count) * 100
+		}
+		rows = append(rows, row)
+	}
+
+	// Ties go in query order, so the table doesn't jump around.
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := sortBy(rows[i]), sortBy(rows[j])
+		if a != b {
+			return a > b
+		}
+		return rows[i].query < rows[j].query
+	})
+	return rows
+}
+
+// formatStatusHeader returns the column headings, lined up with the rows from
+// formatStatusRow.
+func formatStatusHeader() string {
+	header := fmt.Sprintf("%6s  %8s  %7s %7s %7s %7s  %6s %6s %6s %6s  %6s %6s %6s",
+		"count", "rate", "last", "1m", "5m", "15m", "a.last", "a.1m", "a.5m",
+		"a.15m", "min", "avg", "max")
+	for _, p := range percentiles {
+		header += fmt.Sprintf(" %6s", fmt.Sprintf("p%g", p))
+	}
+	header += fmt.Sprintf(" %9s  %8s %9s", "bytes", "nf", "err")
+	if qbufCapacity > 0 {
+		header += fmt.Sprintf(" %7s", "+/-")
+	}
+	return header + "  query"
+}
+
+// formatStatusRow returns one row of the status table as text.
+func formatStatusRow(c *statusRow) string {
+	row := fmt.Sprintf("%6d  %6.2f/s  %7.2f", c.count, c.rate, c.last)
+	for _, rate := range c.windows {
+		row += fmt.Sprintf(" %7.2f", rate)
+	}
+	row += fmt.Sprintf("  %6.2f", c.lastavg)
+	for _, avg := range c.avgs {
+		row += fmt.Sprintf(" %6.2f", avg)
+	}
+	row += fmt.Sprintf("  %6.2f %6.2f %6.2f", c.min, c.avg, c.max)
+	for _, pval := range c.pcts {
+		row += fmt.Sprintf(" %6.2f", pval)
+	}
+	row += fmt.Sprintf(" %8db  %5.1f%%nf %5.1f%%err", c.bytes,
+		c.notfound, c.errors)
+	if qbufCapacity > 0 {
+		row += fmt.Sprintf(" %7d", c.data.overcount)
+	}
+	return row + "  " + c.query
+}
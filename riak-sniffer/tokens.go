@@ -0,0 +1,147 @@
+/*
+ * tokens.go
+ *
+ * Everything the format string can pull out of a request. Each F_XXXXXX token
+ * has an entry here with the names it goes by and how to get its value, so
+ * adding one is a new constant and a new entry.
+ *
+ */
+
+package main
+
+import (
+	"strings"
+
+	"github.com/xb95/riak-sniffer/riakpb"
+)
+
+// A formatTokenDef describes one of the F_XXXXXX tokens. The original tokens
+// have a one letter short name, like #k, and they all have a long name, used
+// like #{key}.
+type formatTokenDef struct {
+	short         string
+	name          string
+	needsResponse bool
+	value         func(rs *riakSource, msg *riakpb.Request, res *riakpb.Response) string
+}
+
+var formatTokens = map[int]*formatTokenDef{
+	F_KEY: {short: "k", name: "key",
+		value: func(rs *riakSource, msg *riakpb.Request, res *riakpb.Response) string {
+			return safe_output(msg.Key)
+		}},
+	F_BUCKET: {short: "b", name: "bucket",
+		value: func(rs *riakSource, msg *riakpb.Request, res *riakpb.Response) string {
+			return string(msg.Bucket)
+		}},
+	F_SOURCE: {short: "s", name: "source",
+		value: func(rs *riakSource, msg *riakpb.Request, res *riakpb.Response) string {
+			return rs.src
+		}},
+	F_SOURCEIP: {short: "i", name: "ip",
+		value: func(rs *riakSource, msg *riakpb.Request, res *riakpb.Response) string {
+			return rs.srcip
+		}},
+	F_METHOD: {short: "m", name: "method",
+		value: func(rs *riakSource, msg *riakpb.Request, res *riakpb.Response) string {
+			return msg.Method
+		}},
+	F_OUTCOME: {short: "o", name: "outcome", needsResponse: true,
+		value: func(rs *riakSource, msg *riakpb.Request, res *riakpb.Response) string {
+			return res.Outcome
+		}},
+	F_ERROR: {short: "e", name: "error", needsResponse: true,
+		value: func(rs *riakSource, msg *riakpb.Request, res *riakpb.Response) string {
+			return safe_output(res.ErrMsg)
+		}},
+
+	// Quorums, or "-" if the client left it up to the bucket.
+	F_R:  quorumToken("r", func(msg *riakpb.Request) *uint32 { return msg.R }),
+	F_W:  quorumToken("w", func(msg *riakpb.Request) *uint32 { return msg.W }),
+	F_PR: quorumToken("pr", func(msg *riakpb.Request) *uint32 { return msg.PR }),
+	F_PW: quorumToken("pw", func(msg *riakpb.Request) *uint32 { return msg.PW }),
+	F_DW: quorumToken("dw", func(msg *riakpb.Request) *uint32 { return msg.DW }),
+	F_RW: quorumToken("rw", func(msg *riakpb.Request) *uint32 { return msg.RW }),
+
+	// Options are their own name if the client set them, otherwise "-".
+	F_HEAD: optionToken("head",
+		func(msg *riakpb.Request) bool { return msg.Head }),
+	F_IFMODIFIED: optionToken("if_modified",
+		func(msg *riakpb.Request) bool { return msg.IfModified }),
+	F_RETURNBODY: optionToken("return_body",
+		func(msg *riakpb.Request) bool { return msg.ReturnBody }),
+	F_RETURNHEAD: optionToken("return_head",
+		func(msg *riakpb.Request) bool { return msg.ReturnHead }),
+	F_IFNOTMODIFIED: optionToken("if_not_modified",
+		func(msg *riakpb.Request) bool { return msg.IfNotModified }),
+	F_IFNONEMATCH: optionToken("if_none_match",
+		func(msg *riakpb.Request) bool { return msg.IfNoneMatch }),
+
+	// What's being stored for puts, otherwise what came back.
+	F_CONTENTTYPE: {name: "content_type", needsResponse: true,
+		value: func(rs *riakSource, msg *riakpb.Request, res *riakpb.Response) string {
+			if len(msg.ContentType) > 0 {
+				return safe_output(msg.ContentType)
+			}
+			return dash(safe_output(res.ContentType))
+		}},
+	F_VALUESIZE: {name: "value_size", needsResponse: true,
+		value: func(rs *riakSource, msg *riakpb.Request, res *riakpb.Response) string {
+			if msg.Method == "put" {
+				return sizeBucket(msg.ValueSize)
+			}
+			if res.Siblings > 0 {
+				return sizeBucket(res.ValueSize)
+			}
+			return "-"
+		}},
+}
+
+func quorumToken(name string, get func(msg *riakpb.Request) *uint32) *formatTokenDef {
+	return &formatTokenDef{name: name,
+		value: func(rs *riakSource, msg *riakpb.Request, res *riakpb.Response) string {
+			return dash(riakpb.QuorumName(get(msg)))
+		}}
+}
+
+func optionToken(name string, get func(msg *riakpb.Request) bool) *formatTokenDef {
+	return &formatTokenDef{name: name,
+		value: func(rs *riakSource, msg *riakpb.Request, res *riakpb.Response) string {
+			if get(msg) {
+				return name
+			}
+			return "-"
+		}}
+}
+
+// lookupToken finds the token with the given short or long name, or returns
+// F_NONE.
+func lookupToken(name string, long bool) int {
+	name = strings.ToLower(name)
+	for token, def := range formatTokens {
+		if long && def.name == name || !long && def.short != "" && def.short == name {
+			return token
+		}
+	}
+	return F_NONE
+}
+
+// Value sizes are bucketed so that they can be aggregated on.
+var sizeBuckets = []struct {
+	max  uint64
+	name string
+}{
+	{1 << 10, "<1K"},
+	{64 << 10, "1K-64K"},
+	{1 << 20, "64K-1M"},
+}
+
+// sizeBucket returns the name of the bucket a value size falls in.
+func sizeBucket(size uint64) string {
+	for _, b := range sizeBuckets {
+		if size < b.max {
+			return b.name
+		}
+	}
+	return ">1M"
+}
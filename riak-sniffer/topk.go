@@ -0,0 +1,88 @@
+/*
+ * topk.go
+ *
+ * Bounded tracking of the most popular queries, for when the aggregation
+ * format has so many distinct values (every key in a big bucket, say) that
+ * keeping all of them would eat the machine.
+ *
+ * This is the Space-Saving algorithm: we keep at most qbufCapacity queries,
+ * and when a new one shows up we evict whichever has the lowest count and
+ * let the new one inherit that count. The inherited part is tracked as the
+ * query's overcount, so a count is never more than overcount too high, and
+ * anything that got evicted was never seen more than the lowest count we're
+ * still tracking.
+ *
+ */
+
+package main
+
+import (
+	"container/heap"
+)
+
+// Maximum number of queries to keep in qbuf. 0 means no limit.
+var qbufCapacity int
+
+// qheap holds the same queryData as qbuf, as a min-heap on count so we can
+// find the one to evict.
+var qheap queryHeap
+
+type queryHeap []*queryData
+
+func (h queryHeap) Len() int           { return len(h) }
+func (h queryHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h queryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *queryHeap) Push(x interface{}) {
+	qdata := x.(*queryData)
+	qdata.index = len(*h)
+	*h = append(*h, qdata)
+}
+
+func (h *queryHeap) Pop() interface{} {
+	old := *h
+	qdata := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return qdata
+}
+
+// newQueryData sets up tracking for a query we haven't seen before, evicting
+// the least popular one if we're at capacity.
+func newQueryData(text string) *queryData {
+	qdata := &queryData{text: text}
+	if qbufCapacity <= 0 {
+		qbuf[text] = qdata
+		return qdata
+	}
+
+	if len(qheap) < qbufCapacity {
+		heap.Push(&qheap, qdata)
+	} else {
+		evict := qheap[0]
+		delete(qbuf, evict.text)
+		qdata.count, qdata.overcount, qdata.index = evict.count,
+			evict.count, 0
+		qheap[0] = qdata
+	}
+	qbuf[text] = qdata
+	return qdata
+}
+
+// countChanged keeps the heap in order after a query's count goes up.
+func countChanged(qdata *queryData) {
+	if qbufCapacity > 0 {
+		heap.Fix(&qheap, qdata.index)
+	}
+}
+
+// countErrorBound returns the most any query we're not tracking could have
+// been seen, which is also the most any count we show could be off by.
+func countErrorBound() uint64 {
+	if len(qheap) < qbufCapacity || len(qheap) == 0 {
+		return 0
+	}
+	return qheap[0].count
+}
@@ -0,0 +1,426 @@
+/*
+ * ui.go
+ *
+ * A full screen, top style view of the status table that updates in place,
+ * for watching things live. It runs off the same qbuf as the status updates
+ * and lets you change the sort order and the aggregation format on the fly,
+ * and drill into a row: from a bucket to its keys, or from a key to the
+ * clients hitting it.
+ *
+ * There's no curses here, just ANSI escapes and stty, which is all a table
+ * that gets redrawn needs.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/xb95/riak-sniffer/riakpb"
+)
+
+var uiEnabled bool
+
+// uiActive is 1 while the UI has the terminal.
+var uiActive int32
+
+// formatLock is held for writing while the UI swaps out the format and
+// filter, and for reading while a request is being formatted.
+var formatLock sync.RWMutex
+
+// formatGen goes up every time the format changes, see aggGen.
+var formatGen int
+
+// When drilled down, only requests with these F_XXXXXX token values count.
+var formatFilter map[int]string
+
+// One level of drilling down, so we can get back out again.
+type uiLevel struct {
+	formatstr string
+	filter    map[int]string
+}
+
+var ui struct {
+	formatstr string
+	levels    []uiLevel
+	since     time.Time // when we last reset qbuf
+	at        time.Time // what time the rows are as of
+	sorts     []string
+	sort      int
+	paused    bool
+	rows      []*statusRow
+	selected  int
+	prompt    *string // format being typed in, if any
+	message   string  // last log line or error
+	stty      string  // terminal settings to restore
+}
+
+// uiLog catches log output, which would otherwise scribble over the screen,
+// and shows the latest line at the bottom.
+type uiLog struct{}
+
+func (uiLog) Write(p []byte) (int, error) {
+	uiLock.Lock()
+	ui.message = strings.TrimSpace(string(p))
+	uiLock.Unlock()
+	return len(p), nil
+}
+
+// uiLock protects the ui struct between the input and refresh goroutines.
+var uiLock sync.Mutex
+
+// filterMatches tells if a request has the token values we're drilled down
+// into. The caller holds formatLock.
+func filterMatches(rs *riakSource, msg *riakpb.Request, res *riakpb.Response) bool {
+	for token, val := range formatFilter {
+		if formatToken(token, rs, msg, res) != val {
+			return false
+		}
+	}
+	return true
+}
+
+// stty runs stty on the terminal and returns what it printed.
+func stty(args ...string) string {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// startUI takes over the terminal. When the user quits, we exit.
+func startUI(formatstr, sortstr string) {
+	ui.formatstr = strings.TrimSpace(formatstr)
+	if ui.formatstr == "" {
+		ui.formatstr = "#b:#k"
+	}
+	ui.sorts = []string{"count", "rate", "bytes", "min", "avg", "max"}
+	for _, p := range percentiles {
+		ui.sorts = append(ui.sorts, fmt.Sprintf("p%g", p))
+	}
+	ui.sorts = append(ui.sorts, "errors", "notfound")
+	for i, name := range ui.sorts {
+		if name == strings.ToLower(strings.TrimSpace(sortstr)) {
+			ui.sort = i
+		}
+	}
+
+	ui.stty = stty("-g")
+	stty("cbreak", "-echo")
+	fmt.Print("\033[?1049h\033[?25l") // alternate screen, hide cursor
+	log.SetOutput(uiLog{})
+	atomic.StoreInt32(&uiActive, 1)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		stopUI()
+		os.Exit(1)
+	}()
+
+	go func() {
+		in := bufio.NewReader(os.Stdin)
+		for {
+			key, err := readKey(in)
+			if err != nil || !handleKey(key) {
+				stopUI()
+				os.Exit(0)
+			}
+			drawUI(false)
+		}
+	}()
+
+	go func() {
+		for {
+			drawUI(true)
+			time.Sleep(time.Duration(statusPeriod) * time.Second)
+		}
+	}()
+}
+
+// stopUI puts the terminal back how we found it. It does nothing if the UI
+// isn't running, so it's safe to call more than once.
+func stopUI() {
+	if !atomic.CompareAndSwapInt32(&uiActive, 1, 0) {
+		return
+	}
+	fmt.Print("\033[?25h\033[?1049l")
+	if ui.stty != "" {
+		stty(ui.stty)
+	}
+	log.SetOutput(os.Stderr)
+}
+
+// fatalf is log.Fatalf, except that it gives the terminal back first if the
+// UI has it. Otherwise the message would only go to the bottom line of a
+// screen that's about to disappear, and the terminal would be left in cbreak
+// mode with no cursor.
+func fatalf(format string, v ...interface{}) {
+	stopUI()
+	log.Fatalf(format, v...)
+}
+
+// readKey reads one keypress, turning the arrow key escape sequences into
+// "up" and "down".
+func readKey(in *bufio.Reader) (string, error) {
+	char, _, err := in.ReadRune()
+	if err != nil {
+		return "", err
+	}
+	if char != 0x1b {
+		return string(char), nil
+	}
+
+	// A lone escape has nothing following it yet.
+	if in.Buffered() == 0 {
+		return "esc", nil
+	}
+	if next, _, _ := in.ReadRune(); next != '[' {
+		return "esc", nil
+	}
+	switch code, _, _ := in.ReadRune(); code {
+	case 'A':
+		return "up", nil
+	case 'B':
+		return "down", nil
+	}
+	return "", nil
+}
+
+// handleKey acts on a keypress. It returns false if it's time to quit.
+func handleKey(key string) bool {
+	uiLock.Lock()
+	defer uiLock.Unlock()
+
+	// While typing a new format, keys go to the prompt.
+	if ui.prompt != nil {
+		switch key {
+		case "\n", "\r":
+			if strings.TrimSpace(*ui.prompt) != "" {
+				ui.levels = nil
+				setFormat(*ui.prompt, nil)
+			}
+			ui.prompt = nil
+		case "esc":
+			ui.prompt = nil
+		case "\x7f", "\b":
+			if len(*ui.prompt) > 0 {
+				_, size := utf8.DecodeLastRuneInString(*ui.prompt)
+				*ui.prompt = (*ui.prompt)[:len(*ui.prompt)-size]
+			}
+		default:
+			if utf8.RuneCountInString(key) == 1 && key[0] >= ' ' {
+				*ui.prompt += key
+			}
+		}
+		return true
+	}
+
+	switch key {
+	case "q":
+		return false
+	case "s", "S":
+		step := 1
+		if key == "S" {
+			step = len(ui.sorts) - 1
+		}
+		ui.sort = (ui.sort + step) % len(ui.sorts)
+		parseSort(ui.sorts[ui.sort])
+		ui.rows = nil // so the new order shows even when paused
+	case "p", " ":
+		ui.paused = !ui.paused
+	case "f":
+		prompt := ui.formatstr
+		ui.prompt = &prompt
+	case "up", "k":
+		if ui.selected > 0 {
+			ui.selected--
+		}
+	case "down", "j":
+		if ui.selected < len(ui.rows)-1 {
+			ui.selected++
+		}
+	case "\n", "\r", "d":
+		drillDown()
+	case "\x7f", "\b", "u":
+		if n := len(ui.levels); n > 0 {
+			level := ui.levels[n-1]
+			ui.levels = ui.levels[:n-1]
+			setFormat(level.formatstr, level.filter)
+		}
+	}
+	return true
+}
+
+// drillDown narrows things down to the selected row, and breaks it out by the
+// next thing worth looking at: keys if we don't have them yet, otherwise the
+// clients.
+func drillDown() {
+	if ui.selected >= len(ui.rows) {
+		return
+	}
+	row := ui.rows[ui.selected]
+
+	has := make(map[int]bool)
+	filter := make(map[int]string)
+	for token, val := range formatFilter {
+		filter[token] = val
+	}
+	for token, val := range row.data.values {
+		has[token] = true
+		filter[token] = val
+	}
+
+	var next string
+	switch {
+	case !has[F_KEY] && has[F_BUCKET]:
+		next = ui.formatstr + ":#k"
+	case !has[F_KEY]:
+		next = ui.formatstr + " #k"
+	case !has[F_SOURCEIP] && !has[F_SOURCE]:
+		next = ui.formatstr + " #i"
+	default:
+		ui.message = "nothing further to drill into"
+		return
+	}
+
+	ui.levels = append(ui.levels, uiLevel{ui.formatstr, formatFilter})
+	setFormat(next, filter)
+}
+
+// setFormat switches to a new aggregation format and filter, and starts the
+// table afresh since what we had was aggregated some other way.
+func setFormat(formatstr string, filter map[int]string) {
+	formatstr = strings.TrimSpace(formatstr)
+
+	formatLock.Lock()
+	format, formatNeedsResponse = compileFormat(formatstr)
+	for token := range filter {
+		if formatTokens[token].needsResponse {
+			formatNeedsResponse = true
+		}
+	}
+	formatFilter = filter
+	formatGen++
+	gen := formatGen
+	formatLock.Unlock()
+
+	aggregate(func() {
+		qbuf = make(map[string]*queryData)
+		qheap = nil
+		aggGen = gen
+		ui.since = aggNow
+	})
+
+	ui.formatstr = formatstr
+	ui.rows = nil
+	ui.selected = 0
+}
+
+// drawUI redraws the screen. If refresh is set, the rows are worked out again
+// unless we're paused.
+func drawUI(refresh bool) {
+	uiLock.Lock()
+	defer uiLock.Unlock()
+
+	if refresh && !ui.paused || ui.rows == nil {
+		aggregate(func() {
+			since := ui.since
+			if since.IsZero() {
+				since = aggStart
+			}
+			elapsed := aggNow.Sub(since).Seconds()
+			if elapsed < 1 {
+				elapsed = 1
+			}
+			ui.rows = getStatusRows(elapsed, aggNow.Unix())
+			ui.at = aggNow
+		})
+	}
+	if ui.selected >= len(ui.rows) {
+		ui.selected = len(ui.rows) - 1
+	}
+	if ui.selected < 0 {
+		ui.selected = 0
+	}
+
+	height, width := 24, 80
+	fmt.Sscan(stty("size"), &height, &width)
+
+	var lines []string
+	title := fmt.Sprintf("riak-sniffer  %s  %d queries  sort: %s",
+		ui.at.Format("15:04:05"), len(ui.rows), ui.sorts[ui.sort])
+	if ui.paused {
+		title += "  [paused]"
+	}
+	lines = append(lines, title)
+	lines = append(lines, "format: "+ui.formatstr)
+	if len(formatFilter) > 0 {
+		var parts []string
+		for _, item := range format {
+			if token, ok := item.(int); ok {
+				if val, ok := formatFilter[token]; ok {
+					parts = append(parts, val)
+				}
+			}
+		}
+		lines[1] += fmt.Sprintf("  within: %s (u to go back)",
+			strings.Join(parts, " "))
+	}
+	lines = append(lines, "s/S sort  p pause  f format  enter drill down  u back up  q quit", "")
+	lines = append(lines, formatStatusHeader())
+
+	// Scroll so the selected row is always on screen.
+	space := height - len(lines) - 1
+	first := 0
+	if ui.selected >= space {
+		first = ui.selected - space + 1
+	}
+	for i := first; i < len(ui.rows) && i < first+space; i++ {
+		line := formatStatusRow(ui.rows[i])
+		if i == ui.selected {
+			line = "\033[7m" + truncate(line, width) + "\033[0m"
+		}
+		lines = append(lines, line)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	out.WriteString("\033[H\033[2J")
+	for _, line := range lines {
+		out.WriteString(truncate(line, width) + "\r\n")
+	}
+
+	// The bottom line is the format prompt or the last thing logged.
+	out.WriteString(fmt.Sprintf("\033[%d;1H", height))
+	if ui.prompt != nil {
+		out.WriteString(truncate("new format: "+*ui.prompt, width))
+	} else {
+		out.WriteString(truncate(ui.message, width))
+	}
+}
+
+// truncate cuts a line down to fit the width of the screen. Escape codes are
+// only ever added after truncating, so they don't need to be accounted for.
+func truncate(line string, width int) string {
+	if strings.HasPrefix(line, "\033[") || utf8.RuneCountInString(line) <= width {
+		return line
+	}
+	return string([]rune(line)[:width])
+}
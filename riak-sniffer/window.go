@@ -0,0 +1,137 @@
+/*
+ * window.go
+ *
+ * Sliding windows of recent activity, so that status updates can show what
+ * is happening now and not just the average since we started sniffing. The
+ * last minute is kept per second and the last fifteen per ten seconds, which
+ * is enough to give load average style 1m/5m/15m numbers.
+ *
+ */
+
+package main
+
+const (
+	fineSlots   = 60 // one second each
+	coarseSlots = 90 // coarseWidth seconds each
+	coarseWidth = 10
+)
+
+// The windows we report on, in seconds, alongside the last status interval.
+var windowLengths = []int64{60, 300, 900}
+
+// A windowSlot adds up everything that happened in one slot of time.
+type windowSlot struct {
+	count     uint64 // requests
+	bytes     uint64
+	timed     uint64 // responses we have a timing for
+	timetotal uint64 // nanoseconds
+}
+
+func (ws *windowSlot) add(other *windowSlot) {
+	ws.count += other.count
+	ws.bytes += other.bytes
+	ws.timed += other.timed
+	ws.timetotal += other.timetotal
+}
+
+// A windowEntry is the slot for one second, or one coarseWidth period.
+type windowEntry struct {
+	at int64
+	windowSlot
+}
+
+// A window is two lists of slots, the last fineSlots seconds and the last
+// coarseSlots periods, oldest first. Only the slots something happened in are
+// kept, as there's a window for every query we're tracking and most of them
+// are pretty quiet.
+type window struct {
+	fine   []windowEntry
+	coarse []windowEntry
+}
+
+// addEntry adds some activity to the entry for at, keeping the list in order
+// and dropping anything that's more than slots older than the newest entry.
+// Activity usually turns up in order, but the listeners each have their own
+// idea of the time, so it can be out by a bit.
+func addEntry(entries []windowEntry, at int64, slots int64,
+	ws *windowSlot) []windowEntry {
+	i := len(entries)
+	for i > 0 && entries[i-1].at > at {
+		i--
+	}
+	if i > 0 && entries[i-1].at == at {
+		entries[i-1].add(ws)
+		return entries
+	}
+
+	entries = append(entries, windowEntry{})
+	copy(entries[i+1:], entries[i:])
+	entries[i] = windowEntry{at: at, windowSlot: *ws}
+	return expireEntries(entries, entries[len(entries)-1].at, slots)
+}
+
+// expireEntries drops the entries that are more than slots older than at.
+func expireEntries(entries []windowEntry, at int64, slots int64) []windowEntry {
+	i := 0
+	for i < len(entries) && at-entries[i].at >= slots {
+		i++
+	}
+	if i == len(entries) {
+		return nil
+	}
+	return entries[i:]
+}
+
+// sumEntries adds up the entries from first to last.
+func sumEntries(entries []windowEntry, first, last int64) windowSlot {
+	var ret windowSlot
+	for i := range entries {
+		if entries[i].at >= first && entries[i].at <= last {
+			ret.add(&entries[i].windowSlot)
+		}
+	}
+	return ret
+}
+
+// add records some activity at the given second. Things that are too old to
+// be in the window anymore are dropped.
+func (w *window) add(sec int64, ws windowSlot) {
+	w.fine = addEntry(w.fine, sec, fineSlots, &ws)
+	w.coarse = addEntry(w.coarse, sec/coarseWidth, coarseSlots, &ws)
+}
+
+// sum adds up the last so many seconds of activity, up to and including the
+// given second. Anything longer than the fine slots is rounded up to a whole
+// number of coarse slots.
+func (w *window) sum(sec, seconds int64) windowSlot {
+	w.fine = expireEntries(w.fine, sec, fineSlots)
+	w.coarse = expireEntries(w.coarse, sec/coarseWidth, coarseSlots)
+
+	if seconds <= fineSlots {
+		return sumEntries(w.fine, sec-seconds+1, sec)
+	}
+
+	period := sec / coarseWidth
+	slots := (seconds + coarseWidth - 1) / coarseWidth
+	if slots > coarseSlots {
+		slots = coarseSlots
+	}
+	return sumEntries(w.coarse, period-slots+1, period)
+}
+
+// windowRate returns the number of requests per second over the last so many
+// seconds. If we haven't been running that long, it's over the time we have.
+func windowRate(ws windowSlot, seconds int64, elapsed float64) float64 {
+	if float64(seconds) > elapsed {
+		return float64(ws.count) / elapsed
+	}
+	return float64(ws.count) / float64(seconds)
+}
+
+// windowLatency returns the average response time in milliseconds.
+func windowLatency(ws windowSlot) float64 {
+	if ws.timed == 0 {
+		return 0
+	}
+	return float64(ws.timetotal/ws.timed) / 1000000
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWindow(t *testing.T) {
+	var w window
+	one := windowSlot{count: 1, bytes: 10, timed: 1, timetotal: 1000000}
+
+	// A request a second for 20 minutes, with one turning up late, which
+	// counts towards everything from the last 2 minutes on.
+	for sec := int64(1000); sec < 2200; sec++ {
+		w.add(sec, one)
+		if sec == 2100 {
+			w.add(2095, one)
+		}
+	}
+
+	tests := []struct {
+		seconds int64
+		count   uint64
+	}{
+		{1, 1},
+		{10, 10},
+		{60, 60},
+		{300, 301},
+		{900, 901},
+		{3600, 901},
+	}
+	for _, test := range tests {
+		ws := w.sum(2199, test.seconds)
+		if ws.count != test.count || ws.bytes != test.count*10 ||
+			ws.timed != test.count {
+			t.Errorf("last %ds: %+v, want %d", test.seconds, ws, test.count)
+		}
+	}
+	if ws := w.sum(2199, 120); ws.count != 121 {
+		t.Errorf("last 120s with the late one: %d", ws.count)
+	}
+
+	// Only the slots that are still in the window are kept.
+	if len(w.fine) != fineSlots || len(w.coarse) != coarseSlots {
+		t.Errorf("%d fine and %d coarse slots", len(w.fine), len(w.coarse))
+	}
+
+	// Once it goes quiet, everything falls out of it.
+	if ws := w.sum(2199+900+10, 900); ws.count != 0 {
+		t.Errorf("quiet for 15 minutes: %+v", ws)
+	}
+	if w.fine != nil || w.coarse != nil {
+		t.Errorf("%d fine and %d coarse slots", len(w.fine), len(w.coarse))
+	}
+
+	// Something too old to count at all is dropped.
+	w.add(5000, one)
+	w.add(4000, one)
+	if len(w.fine) != 1 || len(w.coarse) != 1 {
+		t.Errorf("%d fine and %d coarse slots", len(w.fine), len(w.coarse))
+	}
+	if ws := w.sum(5000, 900); ws.count != 1 {
+		t.Errorf("after an old one: %+v", ws)
+	}
+}
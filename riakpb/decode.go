@@ -0,0 +1,275 @@
+/*
+ * decode.go
+ *
+ * Boiling requests and responses down to the handful of things you'd want to
+ * know about them, whatever their type.
+ *
+ */
+
+package riakpb
+
+import (
+	"encoding/json"
+	"strconv"
+
+	riak "github.com/xb95/riak-sniffer/proto"
+)
+
+// A Request is the gist of a request message.
+type Request struct {
+	Method string // like "get", "put" or "listkeys"
+	Bucket []byte
+	Key    []byte // or whatever stands in for one, like an index query
+
+	// Quorum values the client asked for. nil means the bucket default, and
+	// there are a few special values, see QuorumName.
+	RW *uint32
+	R  *uint32
+	W  *uint32
+	PR *uint32
+	PW *uint32
+	DW *uint32
+
+	Vclock bool // client supplied a vclock
+
+	// Options. These are false for request types that don't have them.
+	Head          bool // get, only the metadata
+	IfModified    bool // get, only if the vclock has changed
+	ReturnBody    bool // put, send back the stored value
+	ReturnHead    bool // put, send back the stored metadata
+	IfNotModified bool // put, only if the vclock hasn't changed
+	IfNoneMatch   bool // put, only if the key doesn't exist
+
+	ContentType []byte // of a stored value or a MapReduce job
+	ValueSize   uint64 // of a stored value
+}
+
+// A Response is the gist of one response frame.
+type Response struct {
+	Outcome     string // found, notfound, unchanged, ok, error or unknown
+	ErrCode     uint32
+	ErrMsg      []byte
+	Siblings    int
+	ValueSize   uint64 // total size of the values returned
+	ContentType []byte // of the first value returned
+	Items       uint64 // keys or MapReduce results in a streaming frame
+	Done        bool   // last frame of the response
+}
+
+// DecodeRequest decodes a request message. It returns ErrNotRequest if the
+// code isn't a request.
+func DecodeRequest(code int, data []byte) (*Request, error) {
+	if !IsRequest(code) {
+		return nil, ErrNotRequest
+	}
+	msg, err := Decode(code, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret *Request
+	switch code {
+	case MsgPingReq:
+		ret = &Request{Method: "ping"}
+	case MsgGetClientIdReq:
+		ret = &Request{Method: "getclientid"}
+	case MsgSetClientIdReq:
+		obj := msg.(*riak.RpbSetClientIdReq)
+		ret = &Request{Method: "setclientid", Key: obj.ClientId}
+	case MsgGetServerInfoReq:
+		ret = &Request{Method: "serverinfo"}
+	case MsgGetReq:
+		obj := msg.(*riak.RpbGetReq)
+		ret = &Request{Method: "get", Bucket: obj.Bucket, Key: obj.Key,
+			R: obj.R, PR: obj.Pr, Head: obj.GetHead(),
+			IfModified: len(obj.IfModified) > 0}
+	case MsgPutReq:
+		obj := msg.(*riak.RpbPutReq)
+		ret = &Request{Method: "put", Bucket: obj.Bucket, Key: obj.Key,
+			W: obj.W, DW: obj.Dw, PW: obj.Pw, Vclock: len(obj.Vclock) > 0,
+			ReturnBody: obj.GetReturnBody(), ReturnHead: obj.GetReturnHead(),
+			IfNotModified: obj.GetIfNotModified(),
+			IfNoneMatch:   obj.GetIfNoneMatch()}
+		if obj.Content != nil {
+			ret.ContentType = obj.Content.ContentType
+			ret.ValueSize = uint64(len(obj.Content.Value))
+		}
+	case MsgDelReq:
+		obj := msg.(*riak.RpbDelReq)
+		ret = &Request{Method: "del", Bucket: obj.Bucket, Key: obj.Key,
+			RW: obj.Rw, R: obj.R, W: obj.W, PR: obj.Pr, PW: obj.Pw, DW: obj.Dw,
+			Vclock: len(obj.Vclock) > 0}
+	case MsgListBucketsReq:
+		ret = &Request{Method: "listbuckets"}
+	case MsgListKeysReq:
+		obj := msg.(*riak.RpbListKeysReq)
+		ret = &Request{Method: "listkeys", Bucket: obj.Bucket}
+	case MsgGetBucketReq:
+		obj := msg.(*riak.RpbGetBucketReq)
+		ret = &Request{Method: "getbucket", Bucket: obj.Bucket}
+	case MsgSetBucketReq:
+		obj := msg.(*riak.RpbSetBucketReq)
+		ret = &Request{Method: "setbucket", Bucket: obj.Bucket}
+	case MsgMapRedReq:
+		obj := msg.(*riak.RpbMapRedReq)
+		ret = &Request{Method: "mapred",
+			Bucket:      mapRedBucket(obj.ContentType, obj.Request),
+			ContentType: obj.ContentType}
+	case MsgIndexReq:
+		obj := msg.(*riak.RpbIndexReq)
+
+		// The "key" is the index along with whatever it is being queried for.
+		key := append(append([]byte{}, obj.Index...), '=')
+		if obj.GetQtype() == riak.RpbIndexReq_range {
+			key = append(append(append(key, obj.RangeMin...), '.', '.'),
+				obj.RangeMax...)
+		} else {
+			key = append(key, obj.Key...)
+		}
+		ret = &Request{Method: "index", Bucket: obj.Bucket, Key: key}
+	case MsgSearchQueryReq:
+		obj := msg.(*riak.RpbSearchQueryReq)
+		ret = &Request{Method: "search", Bucket: obj.Index, Key: obj.Q}
+	}
+	return ret, nil
+}
+
+// DecodeResponse decodes a response frame. Any response we don't specifically
+// care about is just "ok".
+func DecodeResponse(code int, data []byte) (*Response, error) {
+	if !KnownCode(code) {
+		return nil, ErrUnknownCode
+	}
+	msg, err := Decode(code, data)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &Response{Outcome: "ok", Done: true}
+	switch code {
+	case MsgErrorResp:
+		obj := msg.(*riak.RpbErrorResp)
+		ret.Outcome, ret.ErrCode, ret.ErrMsg = "error", obj.GetErrcode(),
+			obj.Errmsg
+	case MsgGetResp:
+		obj := msg.(*riak.RpbGetResp)
+
+		// An empty response is how Riak says "not found".
+		if obj.GetUnchanged() {
+			ret.Outcome = "unchanged"
+		} else if len(obj.Content) == 0 {
+			ret.Outcome = "notfound"
+		} else {
+			ret.Outcome = "found"
+		}
+		ret.Siblings, ret.ValueSize = contentSize(obj.Content)
+		ret.ContentType = contentType(obj.Content)
+	case MsgPutResp:
+		// Only has content if the client asked for return_body.
+		obj := msg.(*riak.RpbPutResp)
+		ret.Siblings, ret.ValueSize = contentSize(obj.Content)
+		ret.ContentType = contentType(obj.Content)
+	case MsgListKeysResp:
+		// Keys come back in batches, the last one says it's done.
+		obj := msg.(*riak.RpbListKeysResp)
+		ret.Items, ret.Done = uint64(len(obj.Keys)), obj.GetDone()
+	case MsgMapRedResp:
+		// One frame per phase result, then an empty one that's done.
+		obj := msg.(*riak.RpbMapRedResp)
+		if obj.Response != nil {
+			ret.Items = 1
+		}
+		ret.Done = obj.GetDone()
+	}
+	return ret, nil
+}
+
+// contentSize returns the number of siblings and their total size.
+func contentSize(content []*riak.RpbContent) (int, uint64) {
+	var size uint64
+	for _, c := range content {
+		size += uint64(len(c.Value))
+	}
+	return len(content), size
+}
+
+// contentType returns the content type of the first sibling, if there is one.
+func contentType(content []*riak.RpbContent) []byte {
+	if len(content) == 0 {
+		return nil
+	}
+	return content[0].ContentType
+}
+
+// Special quorum values, which clients can send instead of a number.
+const (
+	QuorumOne     = 0xfffffffe
+	QuorumQuorum  = 0xfffffffd
+	QuorumAll     = 0xfffffffc
+	QuorumDefault = 0xfffffffb
+)
+
+// QuorumName returns a quorum value as text: a number, one of the special
+// names, or "" if the client didn't send it.
+func QuorumName(val *uint32) string {
+	if val == nil {
+		return ""
+	}
+	switch *val {
+	case QuorumOne:
+		return "one"
+	case QuorumQuorum:
+		return "quorum"
+	case QuorumAll:
+		return "all"
+	case QuorumDefault:
+		return "default"
+	}
+	return strconv.FormatUint(uint64(*val), 10)
+}
+
+// mapRedBucket digs the input bucket out of a JSON MapReduce job, if there is
+// just the one. Jobs can give their inputs as a bucket name, an object with a
+// bucket (key filters or index queries), or a list of [bucket, key, ...]
+// lists. Erlang term jobs we don't even try.
+func mapRedBucket(ctype, job []byte) []byte {
+	if string(ctype) != "application/json" {
+		return nil
+	}
+
+	var req struct {
+		Inputs json.RawMessage `json:"inputs"`
+	}
+	if json.Unmarshal(job, &req) != nil {
+		return nil
+	}
+
+	var bucket string
+	if json.Unmarshal(req.Inputs, &bucket) == nil {
+		return []byte(bucket)
+	}
+
+	var obj struct {
+		Bucket string `json:"bucket"`
+	}
+	if json.Unmarshal(req.Inputs, &obj) == nil {
+		return []byte(obj.Bucket)
+	}
+
+	var list [][]interface{}
+	if json.Unmarshal(req.Inputs, &list) == nil {
+		for _, input := range list {
+			if len(input) == 0 {
+				return nil
+			}
+			name, ok := input[0].(string)
+			if !ok || (bucket != "" && name != bucket) {
+				return nil
+			}
+			bucket = name
+		}
+		return []byte(bucket)
+	}
+
+	return nil
+}
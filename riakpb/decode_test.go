@@ -0,0 +1,258 @@
+package riakpb
+
+import (
+	"reflect"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+	riak "github.com/xb95/riak-sniffer/proto"
+)
+
+func TestDecodeRequest(t *testing.T) {
+	job := []byte(`{"inputs":"users","query":[]}`)
+	json := []byte("application/json")
+
+	tests := []struct {
+		code int
+		msg  proto.Message
+		want *Request
+	}{
+		{MsgPingReq, nil, &Request{Method: "ping"}},
+		{MsgGetClientIdReq, nil, &Request{Method: "getclientid"}},
+		{MsgSetClientIdReq, &riak.RpbSetClientIdReq{ClientId: []byte("me")},
+			&Request{Method: "setclientid", Key: []byte("me")}},
+		{MsgGetServerInfoReq, nil, &Request{Method: "serverinfo"}},
+		{MsgGetReq, &riak.RpbGetReq{Bucket: []byte("b"), Key: []byte("k"),
+			R: proto.Uint32(QuorumQuorum), Pr: proto.Uint32(1),
+			Head: proto.Bool(true), IfModified: []byte("vc")},
+			&Request{Method: "get", Bucket: []byte("b"), Key: []byte("k"),
+				R: proto.Uint32(QuorumQuorum), PR: proto.Uint32(1), Head: true,
+				IfModified: true}},
+		{MsgPutReq, &riak.RpbPutReq{Bucket: []byte("b"), Key: []byte("k"),
+			Vclock: []byte("vc"), W: proto.Uint32(2), Dw: proto.Uint32(1),
+			Pw: proto.Uint32(QuorumAll), ReturnBody: proto.Bool(true),
+			ReturnHead: proto.Bool(true), IfNotModified: proto.Bool(true),
+			IfNoneMatch: proto.Bool(true),
+			Content: &riak.RpbContent{Value: []byte("hello"),
+				ContentType: []byte("text/plain")}},
+			&Request{Method: "put", Bucket: []byte("b"), Key: []byte("k"),
+				W: proto.Uint32(2), DW: proto.Uint32(1),
+				PW: proto.Uint32(QuorumAll), Vclock: true, ReturnBody: true,
+				ReturnHead: true, IfNotModified: true, IfNoneMatch: true,
+				ContentType: []byte("text/plain"), ValueSize: 5}},
+		{MsgDelReq, &riak.RpbDelReq{Bucket: []byte("b"), Key: []byte("k"),
+			Rw: proto.Uint32(3), R: proto.Uint32(2), W: proto.Uint32(1),
+			Pr: proto.Uint32(QuorumOne), Pw: proto.Uint32(QuorumDefault),
+			Dw: proto.Uint32(0)},
+			&Request{Method: "del", Bucket: []byte("b"), Key: []byte("k"),
+				RW: proto.Uint32(3), R: proto.Uint32(2), W: proto.Uint32(1),
+				PR: proto.Uint32(QuorumOne), PW: proto.Uint32(QuorumDefault),
+				DW: proto.Uint32(0)}},
+		{MsgListBucketsReq, nil, &Request{Method: "listbuckets"}},
+		{MsgListKeysReq, &riak.RpbListKeysReq{Bucket: []byte("b")},
+			&Request{Method: "listkeys", Bucket: []byte("b")}},
+		{MsgGetBucketReq, &riak.RpbGetBucketReq{Bucket: []byte("b")},
+			&Request{Method: "getbucket", Bucket: []byte("b")}},
+		{MsgSetBucketReq, &riak.RpbSetBucketReq{Bucket: []byte("b"),
+			Props: &riak.RpbBucketProps{NVal: proto.Uint32(3)}},
+			&Request{Method: "setbucket", Bucket: []byte("b")}},
+		{MsgMapRedReq, &riak.RpbMapRedReq{Request: job, ContentType: json},
+			&Request{Method: "mapred", Bucket: []byte("users"),
+				ContentType: json}},
+		{MsgIndexReq, &riak.RpbIndexReq{Bucket: []byte("b"),
+			Index: []byte("age_int"), Qtype: riak.RpbIndexReq_eq.Enum(),
+			Key: []byte("30")},
+			&Request{Method: "index", Bucket: []byte("b"),
+				Key: []byte("age_int=30")}},
+		{MsgIndexReq, &riak.RpbIndexReq{Bucket: []byte("b"),
+			Index: []byte("age_int"), Qtype: riak.RpbIndexReq_range.Enum(),
+			RangeMin: []byte("1"), RangeMax: []byte("9")},
+			&Request{Method: "index", Bucket: []byte("b"),
+				Key: []byte("age_int=1..9")}},
+		{MsgSearchQueryReq, &riak.RpbSearchQueryReq{Q: []byte("name:bob"),
+			Index: []byte("people")},
+			&Request{Method: "search", Bucket: []byte("people"),
+				Key: []byte("name:bob")}},
+	}
+
+	seen := make(map[int]bool)
+	for _, test := range tests {
+		seen[test.code] = true
+		got, err := DecodeRequest(test.code, body(t, test.msg))
+		if err != nil {
+			t.Errorf("%d: %s", test.code, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d: got %+v, want %+v", test.code, got, test.want)
+		}
+	}
+	for code := range messageTypes {
+		if IsRequest(code) && !seen[code] {
+			t.Errorf("request code %d isn't tested", code)
+		}
+	}
+}
+
+func TestDecodeRequestErrors(t *testing.T) {
+	if _, err := DecodeRequest(MsgGetResp, nil); err != ErrNotRequest {
+		t.Errorf("response code: got %v, want ErrNotRequest", err)
+	}
+	if _, err := DecodeRequest(MsgErrorResp, nil); err != ErrNotRequest {
+		t.Errorf("error code: got %v, want ErrNotRequest", err)
+	}
+	if _, err := DecodeRequest(0x7f, nil); err != ErrNotRequest {
+		t.Errorf("unknown code: got %v, want ErrNotRequest", err)
+	}
+	if req, err := DecodeRequest(MsgGetReq, []byte{0x0f, 0xff}); err == nil {
+		t.Errorf("garbage get decoded as %+v", req)
+	}
+}
+
+func TestDecodeResponse(t *testing.T) {
+	content := []*riak.RpbContent{
+		{Value: []byte("hello"), ContentType: []byte("text/plain")},
+		{Value: []byte("bye")},
+	}
+
+	tests := []struct {
+		name string
+		code int
+		msg  proto.Message
+		want *Response
+	}{
+		{"error", MsgErrorResp, &riak.RpbErrorResp{Errmsg: []byte("oops"),
+			Errcode: proto.Uint32(7)},
+			&Response{Outcome: "error", ErrCode: 7, ErrMsg: []byte("oops"),
+				Done: true}},
+		{"ping", MsgPingResp, nil, &Response{Outcome: "ok", Done: true}},
+		{"getclientid", MsgGetClientIdResp,
+			&riak.RpbGetClientIdResp{ClientId: []byte("me")},
+			&Response{Outcome: "ok", Done: true}},
+		{"setclientid", MsgSetClientIdResp, nil,
+			&Response{Outcome: "ok", Done: true}},
+		{"serverinfo", MsgGetServerInfoResp, &riak.RpbGetServerInfoResp{
+			Node: []byte("riak@host"), ServerVersion: []byte("1.2")},
+			&Response{Outcome: "ok", Done: true}},
+		{"found", MsgGetResp, &riak.RpbGetResp{Content: content,
+			Vclock: []byte("vc")},
+			&Response{Outcome: "found", Siblings: 2, ValueSize: 8,
+				ContentType: []byte("text/plain"), Done: true}},
+		{"notfound", MsgGetResp, &riak.RpbGetResp{},
+			&Response{Outcome: "notfound", Done: true}},
+		{"unchanged", MsgGetResp, &riak.RpbGetResp{Unchanged: proto.Bool(true)},
+			&Response{Outcome: "unchanged", Done: true}},
+		{"put", MsgPutResp, nil, &Response{Outcome: "ok", Done: true}},
+		{"put with body", MsgPutResp, &riak.RpbPutResp{Content: content[:1],
+			Key: []byte("k")},
+			&Response{Outcome: "ok", Siblings: 1, ValueSize: 5,
+				ContentType: []byte("text/plain"), Done: true}},
+		{"del", MsgDelResp, nil, &Response{Outcome: "ok", Done: true}},
+		{"listbuckets", MsgListBucketsResp, &riak.RpbListBucketsResp{
+			Buckets: [][]byte{[]byte("a"), []byte("b")}},
+			&Response{Outcome: "ok", Done: true}},
+		{"listkeys", MsgListKeysResp, &riak.RpbListKeysResp{
+			Keys: [][]byte{[]byte("a"), []byte("b"), []byte("c")}},
+			&Response{Outcome: "ok", Items: 3}},
+		{"listkeys done", MsgListKeysResp,
+			&riak.RpbListKeysResp{Done: proto.Bool(true)},
+			&Response{Outcome: "ok", Done: true}},
+		{"getbucket", MsgGetBucketResp, &riak.RpbGetBucketResp{
+			Props: &riak.RpbBucketProps{AllowMult: proto.Bool(true)}},
+			&Response{Outcome: "ok", Done: true}},
+		{"setbucket", MsgSetBucketResp, nil,
+			&Response{Outcome: "ok", Done: true}},
+		{"mapred", MsgMapRedResp, &riak.RpbMapRedResp{Phase: proto.Uint32(0),
+			Response: []byte("[1]")},
+			&Response{Outcome: "ok", Items: 1}},
+		{"mapred done", MsgMapRedResp, &riak.RpbMapRedResp{Done: proto.Bool(true)},
+			&Response{Outcome: "ok", Done: true}},
+		{"index", MsgIndexResp, &riak.RpbIndexResp{Keys: [][]byte{[]byte("k")}},
+			&Response{Outcome: "ok", Done: true}},
+		{"search", MsgSearchQueryResp, &riak.RpbSearchQueryResp{
+			MaxScore: proto.Float32(1.5), NumFound: proto.Uint32(0)},
+			&Response{Outcome: "ok", Done: true}},
+	}
+
+	seen := make(map[int]bool)
+	for _, test := range tests {
+		seen[test.code] = true
+		got, err := DecodeResponse(test.code, body(t, test.msg))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+	for code := range messageTypes {
+		if !IsRequest(code) && !seen[code] {
+			t.Errorf("response code %d isn't tested", code)
+		}
+	}
+}
+
+func TestDecodeResponseErrors(t *testing.T) {
+	if _, err := DecodeResponse(0x7f, nil); err != ErrUnknownCode {
+		t.Errorf("unknown code: got %v, want ErrUnknownCode", err)
+	}
+	if res, err := DecodeResponse(MsgGetResp, []byte{0x0f, 0xff}); err == nil {
+		t.Errorf("garbage get response decoded as %+v", res)
+	}
+}
+
+func TestMapRedBucket(t *testing.T) {
+	json := "application/json"
+	tests := []struct {
+		name  string
+		ctype string
+		job   string
+		want  string // "" for no bucket
+	}{
+		{"bucket", json, `{"inputs":"users","query":[]}`, "users"},
+		{"key filters", json,
+			`{"inputs":{"bucket":"users","key_filters":[["ends_with","1"]]}}`,
+			"users"},
+		{"index query", json,
+			`{"inputs":{"bucket":"users","index":"age_int","start":1,"end":9}}`,
+			"users"},
+		{"one pair", json, `{"inputs":[["users","a"]]}`, "users"},
+		{"same bucket", json,
+			`{"inputs":[["users","a"],["users","b","keydata"]]}`, "users"},
+		{"mixed buckets", json, `{"inputs":[["users","a"],["logs","b"]]}`, ""},
+		{"empty input", json, `{"inputs":[["users","a"],[]]}`, ""},
+		{"not a bucket name", json, `{"inputs":[[1,"a"]]}`, ""},
+		{"no inputs", json, `{"query":[]}`, ""},
+		{"erlang", "application/x-erlang-binary", `{"inputs":"users"}`, ""},
+		{"no content type", "", `{"inputs":"users"}`, ""},
+		{"bad json", json, `{"inputs":`, ""},
+	}
+
+	for _, test := range tests {
+		got := mapRedBucket([]byte(test.ctype), []byte(test.job))
+		if string(got) != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestQuorumName(t *testing.T) {
+	tests := []struct {
+		val  *uint32
+		want string
+	}{
+		{nil, ""},
+		{proto.Uint32(0), "0"},
+		{proto.Uint32(3), "3"},
+		{proto.Uint32(QuorumOne), "one"},
+		{proto.Uint32(QuorumQuorum), "quorum"},
+		{proto.Uint32(QuorumAll), "all"},
+		{proto.Uint32(QuorumDefault), "default"},
+	}
+	for _, test := range tests {
+		if got := QuorumName(test.val); got != test.want {
+			t.Errorf("QuorumName(%v) = %q, want %q", test.val, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+/*
+ * frame.go
+ *
+ * Splitting a stream of bytes into frames, either a buffer at a time (when
+ * the bytes arrive in dribs and drabs, like out of a packet capture) or from
+ * an io.Reader.
+ *
+ */
+
+package riakpb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+var (
+	ErrUnknownCode        = errors.New("unknown message code")
+	ErrNotRequest         = errors.New("not a request")
+	ErrEmptyFrame         = errors.New("frame has no message code")
+	ErrFrameTooBig        = errors.New("frame too big")
+	ErrUnexpectedResponse = errors.New("response doesn't match the request")
+)
+
+// Anything claiming to be bigger than this when we're trying to sync is
+// probably not actually a request. Gets, deletes, index queries and so on are
+// a few hundred bytes at most, only a put with a big value gets near this.
+// Passing on one of those costs us nothing, there'll be a small request along
+// in a moment, whereas believing a bogus length means buffering until it's
+// satisfied before we can tell we were wrong.
+const MaxSyncFrame = 64 << 10
+
+// Frames bigger than this (in bytes, including the code) are taken to be
+// garbage. Riak won't store values anywhere near this big, so a length header
+// claiming more than this means we're not where we think we are in the stream.
+const DefaultMaxFrame = 64 << 20
+
+// frameSize returns the length from a frame header, which counts the code
+// byte but not itself.
+func frameSize(buf []byte) uint32 {
+	return binary.BigEndian.Uint32(buf[:4])
+}
+
+// Carve tries to pull a frame off the front of a buffer. If there's a whole
+// one it returns the code and body, and removes those bytes from the buffer.
+// Otherwise the code is -1 and the buffer is left alone.
+//
+// If the buffer starts with a frame that can't be right, because it's empty
+// or bigger than DefaultMaxFrame, it returns ErrEmptyFrame or ErrFrameTooBig.
+// Whatever is in the buffer isn't a frame, and the caller has lost its place
+// in the stream.
+//
+// The body is a slice of the buffer, not a copy.
+func Carve(buf *[]byte) (int, []byte, error) {
+	datalen := uint64(len(*buf))
+	if datalen < 5 {
+		return -1, nil, nil
+	}
+
+	// Every message has at least a code byte.
+	size := uint64(frameSize(*buf))
+	if size == 0 {
+		return -1, nil, ErrEmptyFrame
+	}
+	if size > DefaultMaxFrame {
+		return -1, nil, ErrFrameTooBig
+	}
+	if datalen < size+4 {
+		return -1, nil, nil
+	}
+
+	end := size + 4
+	code := int((*buf)[4])
+	data := (*buf)[5:end]
+	if end >= datalen {
+		*buf = nil
+	} else {
+		*buf = (*buf)[end:]
+	}
+	return code, data, nil
+}
+
+// CheckRequest looks at the start of a buffer to see if it is a request that
+// a decoder that has lost its place could synchronize on: the length has to
+// be sane, the code has to be a request and, once we have all of it, the body
+// has to decode as that request. complete is false if it looks fine so far
+// but we need more of it to be sure.
+func CheckRequest(buf []byte) (valid, complete bool) {
+	if len(buf) < 5 {
+		return true, false
+	}
+
+	size := frameSize(buf)
+	if size == 0 || size > MaxSyncFrame {
+		return false, false
+	}
+	code := int(buf[4])
+	if !IsRequest(code) {
+		return false, false
+	}
+	if !HasBody(code) {
+		return size == 1, true
+	}
+	if uint64(len(buf)) < uint64(size)+4 {
+		return true, false
+	}
+
+	if proto.Unmarshal(buf[5:size+4], NewMessage(code)) != nil {
+		return false, false
+	}
+	return true, true
+}
+
+// A Reader reads frames from an io.Reader, like a connection to Riak.
+type Reader struct {
+	r *bufio.Reader
+
+	// Frames bigger than this (in bytes, including the code) are an error.
+	// It starts out as DefaultMaxFrame, 0 means no limit.
+	MaxFrame uint32
+}
+
+// NewReader returns a Reader that reads frames from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r), MaxFrame: DefaultMaxFrame}
+}
+
+// ReadFrame reads the next frame, returning its code and body. It returns
+// io.EOF if the stream ends cleanly between frames, and io.ErrUnexpectedEOF
+// if it ends partway through one.
+func (r *Reader) ReadFrame() (int, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		return -1, nil, err
+	}
+
+	size := frameSize(header[:])
+	if size == 0 {
+		return -1, nil, ErrEmptyFrame
+	}
+	if r.MaxFrame > 0 && size > r.MaxFrame {
+		return -1, nil, ErrFrameTooBig
+	}
+
+	data := make([]byte, size-1)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return -1, nil, err
+	}
+	return int(header[4]), data, nil
+}
+
+// AppendFrame appends a frame with the given code and body to buf.
+func AppendFrame(buf []byte, code int, data []byte) []byte {
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)+1))
+	header[4] = byte(code)
+	return append(append(buf, header[:]...), data...)
+}
+
+// EncodeFrame marshals a message and frames it. msg can be nil for messages
+// that don't have a body.
+func EncodeFrame(code int, msg proto.Message) ([]byte, error) {
+	var data []byte
+	if msg != nil {
+		var err error
+		if data, err = proto.Marshal(msg); err != nil {
+			return nil, err
+		}
+	}
+	return AppendFrame(nil, code, data), nil
+}
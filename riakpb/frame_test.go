@@ -0,0 +1,270 @@
+package riakpb
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+	riak "github.com/xb95/riak-sniffer/proto"
+)
+
+// frame encodes a message, failing the test if it can't.
+func frame(t *testing.T, code int, msg proto.Message) []byte {
+	data, err := EncodeFrame(code, msg)
+	if err != nil {
+		t.Fatalf("encoding %d: %s", code, err)
+	}
+	return data
+}
+
+// body returns just the protobuf part of a message.
+func body(t *testing.T, msg proto.Message) []byte {
+	if msg == nil {
+		return nil
+	}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func concat(bufs ...[]byte) []byte {
+	var ret []byte
+	for _, buf := range bufs {
+		ret = append(ret, buf...)
+	}
+	return ret
+}
+
+func TestEncodeFrame(t *testing.T) {
+	ping := frame(t, MsgPingReq, nil)
+	if !bytes.Equal(ping, []byte{0, 0, 0, 1, MsgPingReq}) {
+		t.Errorf("ping frame is %v", ping)
+	}
+
+	get := &riak.RpbGetReq{Bucket: []byte("b"), Key: []byte("k")}
+	data := frame(t, MsgGetReq, get)
+	want := AppendFrame(nil, MsgGetReq, body(t, get))
+	if !bytes.Equal(data, want) {
+		t.Errorf("get frame is %v, want %v", data, want)
+	}
+	if int(frameSize(data)) != len(data)-4 {
+		t.Errorf("frame size %d for %d bytes", frameSize(data), len(data))
+	}
+}
+
+func TestCarve(t *testing.T) {
+	get := &riak.RpbGetReq{Bucket: []byte("b"), Key: []byte("k")}
+	getFrame := frame(t, MsgGetReq, get)
+	ping := frame(t, MsgPingReq, nil)
+
+	type carved struct {
+		code int
+		data []byte
+	}
+	tests := []struct {
+		name string
+		buf  []byte
+		want []carved // every frame we should get out, in order
+		left int      // bytes still in the buffer after that
+		err  error
+	}{
+		{"empty", nil, nil, 0, nil},
+		{"partial header", getFrame[:3], nil, 3, nil},
+		{"header only", getFrame[:5], nil, 5, nil},
+		{"partial body", getFrame[:len(getFrame)-1], nil, len(getFrame) - 1, nil},
+		{"whole frame", getFrame,
+			[]carved{{MsgGetReq, body(t, get)}}, 0, nil},
+		{"no body", ping, []carved{{MsgPingReq, []byte{}}}, 0, nil},
+		{"several frames", concat(ping, getFrame, ping),
+			[]carved{{MsgPingReq, []byte{}}, {MsgGetReq, body(t, get)},
+				{MsgPingReq, []byte{}}}, 0, nil},
+		{"frame and a bit", concat(getFrame, ping[:3]),
+			[]carved{{MsgGetReq, body(t, get)}}, 3, nil},
+		{"zero size", []byte{0, 0, 0, 0, 9, 9, 9}, nil, 7, ErrEmptyFrame},
+		{"frame then zero size", concat(ping, []byte{0, 0, 0, 0, 1}),
+			[]carved{{MsgPingReq, []byte{}}}, 5, ErrEmptyFrame},
+		{"biggest frame", []byte{0x04, 0, 0, 0, MsgGetResp, 1}, nil, 6, nil},
+		{"too big", []byte{0x04, 0, 0, 1, MsgGetResp, 1}, nil, 6,
+			ErrFrameTooBig},
+		{"size wraps", []byte{0xff, 0xff, 0xff, 0xfd, MsgGetResp, 1, 2, 3},
+			nil, 8, ErrFrameTooBig},
+		{"biggest size", []byte{0xff, 0xff, 0xff, 0xff, MsgGetResp, 1, 2, 3},
+			nil, 8, ErrFrameTooBig},
+		{"frame then too big", concat(ping, []byte{0x10, 0, 0, 0, 1}),
+			[]carved{{MsgPingReq, []byte{}}}, 5, ErrFrameTooBig},
+	}
+
+	for _, test := range tests {
+		buf := append([]byte{}, test.buf...)
+		var got []carved
+		var err error
+		for {
+			var code int
+			var data []byte
+			if code, data, err = Carve(&buf); code == -1 {
+				break
+			}
+			got = append(got, carved{code, data})
+		}
+
+		if err != test.err {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: carved %d frames, want %d", test.name, len(got),
+				len(test.want))
+			continue
+		}
+		for i := range got {
+			if got[i].code != test.want[i].code ||
+				!bytes.Equal(got[i].data, test.want[i].data) {
+				t.Errorf("%s: frame %d is %v, want %v", test.name, i, got[i],
+					test.want[i])
+			}
+		}
+		if len(buf) != test.left {
+			t.Errorf("%s: %d bytes left, want %d", test.name, len(buf),
+				test.left)
+		}
+	}
+}
+
+// A frame that arrives in pieces comes out once it's all there.
+func TestCarveIncremental(t *testing.T) {
+	get := &riak.RpbGetReq{Bucket: []byte("bucket"), Key: []byte("key")}
+	stream := concat(frame(t, MsgGetReq, get), frame(t, MsgPingReq, nil))
+
+	var buf []byte
+	var codes []int
+	for _, b := range stream {
+		buf = append(buf, b)
+		for {
+			code, _, err := Carve(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code == -1 {
+				break
+			}
+			codes = append(codes, code)
+		}
+	}
+	if len(codes) != 2 || codes[0] != MsgGetReq || codes[1] != MsgPingReq {
+		t.Errorf("carved %v", codes)
+	}
+	if len(buf) != 0 {
+		t.Errorf("%d bytes left over", len(buf))
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	get := &riak.RpbGetReq{Bucket: []byte("b"), Key: []byte("k")}
+	getFrame := frame(t, MsgGetReq, get)
+	ping := frame(t, MsgPingReq, nil)
+	def := uint32(DefaultMaxFrame)
+
+	if r := NewReader(nil); r.MaxFrame != def {
+		t.Errorf("MaxFrame starts out as %d", r.MaxFrame)
+	}
+
+	tests := []struct {
+		name     string
+		stream   []byte
+		maxFrame uint32
+		codes    []int // frames read before the error
+		err      error
+	}{
+		{"empty", nil, def, nil, io.EOF},
+		{"frames", concat(getFrame, ping), def,
+			[]int{MsgGetReq, MsgPingReq}, io.EOF},
+		{"partial header", concat(ping, getFrame[:3]), def,
+			[]int{MsgPingReq}, io.ErrUnexpectedEOF},
+		{"partial body", concat(ping, getFrame[:len(getFrame)-2]), def,
+			[]int{MsgPingReq}, io.ErrUnexpectedEOF},
+		{"header only", getFrame[:5], def, nil, io.ErrUnexpectedEOF},
+		{"zero size", []byte{0, 0, 0, 0, 1}, def, nil, ErrEmptyFrame},
+		{"under max", getFrame, uint32(len(getFrame) - 4), []int{MsgGetReq},
+			io.EOF},
+		{"over max", concat(ping, getFrame), uint32(len(getFrame) - 5),
+			[]int{MsgPingReq}, ErrFrameTooBig},
+		{"over default max", concat(ping, []byte{0x04, 0, 0, 1, 1}), def,
+			[]int{MsgPingReq}, ErrFrameTooBig},
+		{"size wraps", []byte{0xff, 0xff, 0xff, 0xfd, 1, 2, 3}, def, nil,
+			ErrFrameTooBig},
+		{"no limit", []byte{0x04, 0, 0, 1, 1, 2, 3}, 0, nil,
+			io.ErrUnexpectedEOF},
+	}
+
+	for _, test := range tests {
+		r := NewReader(bytes.NewReader(test.stream))
+		r.MaxFrame = test.maxFrame
+
+		var codes []int
+		var err error
+		for {
+			var code int
+			var data []byte
+			if code, data, err = r.ReadFrame(); err != nil {
+				break
+			}
+			codes = append(codes, code)
+			if code == MsgGetReq && !bytes.Equal(data, body(t, get)) {
+				t.Errorf("%s: get body is %v", test.name, data)
+			}
+		}
+
+		if err != test.err {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+		}
+		if len(codes) != len(test.codes) {
+			t.Errorf("%s: read %v, want %v", test.name, codes, test.codes)
+			continue
+		}
+		for i := range codes {
+			if codes[i] != test.codes[i] {
+				t.Errorf("%s: read %v, want %v", test.name, codes, test.codes)
+			}
+		}
+	}
+}
+
+func TestCheckRequest(t *testing.T) {
+	getFrame := frame(t, MsgGetReq, &riak.RpbGetReq{Bucket: []byte("b"),
+		Key: []byte("k")})
+
+	tests := []struct {
+		name            string
+		buf             []byte
+		valid, complete bool
+	}{
+		{"empty", nil, true, false},
+		{"short", getFrame[:4], true, false},
+		{"zero size", []byte{0, 0, 0, 0, MsgGetReq}, false, false},
+		{"too big", []byte{0x10, 0, 0, 0, MsgGetReq}, false, false},
+		{"biggest put", []byte{0, 1, 0, 0, MsgPutReq}, true, false},
+		{"put too big to sync on", []byte{0, 1, 0, 1, MsgPutReq}, false, false},
+		{"response", frame(t, MsgPingResp, nil), false, false},
+		{"error response", frame(t, MsgErrorResp, &riak.RpbErrorResp{
+			Errmsg: []byte("x"), Errcode: proto.Uint32(1)}), false, false},
+		{"unknown code", []byte{0, 0, 0, 1, 0x7f}, false, false},
+		{"ping", frame(t, MsgPingReq, nil), true, true},
+		{"ping with a body", []byte{0, 0, 0, 2, MsgPingReq, 0}, false, true},
+		{"get header", getFrame[:5], true, false},
+		{"partial get", getFrame[:len(getFrame)-1], true, false},
+		{"get", getFrame, true, true},
+		{"get and more", concat(getFrame, getFrame[:3]), true, true},
+		{"garbage get", AppendFrame(nil, MsgGetReq, []byte{0x0f, 0xff}),
+			false, false},
+	}
+
+	for _, test := range tests {
+		valid, complete := CheckRequest(test.buf)
+		if valid != test.valid || complete != test.complete {
+			t.Errorf("%s: got valid=%v complete=%v, want %v %v", test.name,
+				valid, complete, test.valid, test.complete)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+/*
+ * riakpb.go
+ *
+ * Package riakpb decodes the Riak protocol buffers wire protocol: frames, the
+ * messages in them, and requests paired up with their responses. It's what
+ * riak-sniffer uses to make sense of the traffic it sees, and doesn't know
+ * anything about packet capture, so other tools (proxies, replayers) can use
+ * it too.
+ *
+ * Every message on the wire is a frame: a 4 byte big endian length, then a
+ * 1 byte message code, then length-1 bytes of protobuf encoded body. Clients
+ * send requests and Riak answers each one, in order, with the response code
+ * (the request code plus one) or an error.
+ *
+ */
+
+package riakpb
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	riak "github.com/xb95/riak-sniffer/proto"
+)
+
+// Message codes.
+const (
+	MsgErrorResp         = 0x00
+	MsgPingReq           = 0x01
+	MsgPingResp          = 0x02
+	MsgGetClientIdReq    = 0x03
+	MsgGetClientIdResp   = 0x04
+	MsgSetClientIdReq    = 0x05
+	MsgSetClientIdResp   = 0x06
+	MsgGetServerInfoReq  = 0x07
+	MsgGetServerInfoResp = 0x08
+	MsgGetReq            = 0x09
+	MsgGetResp           = 0x0a
+	MsgPutReq            = 0x0b
+	MsgPutResp           = 0x0c
+	MsgDelReq            = 0x0d
+	MsgDelResp           = 0x0e
+	MsgListBucketsReq    = 0x0f
+	MsgListBucketsResp   = 0x10
+	MsgListKeysReq       = 0x11
+	MsgListKeysResp      = 0x12
+	MsgGetBucketReq      = 0x13
+	MsgGetBucketResp     = 0x14
+	MsgSetBucketReq      = 0x15
+	MsgSetBucketResp     = 0x16
+	MsgMapRedReq         = 0x17
+	MsgMapRedResp        = 0x18
+	MsgIndexReq          = 0x19
+	MsgIndexResp         = 0x1a
+	MsgSearchQueryReq    = 0x1b
+	MsgSearchQueryResp   = 0x1c
+)
+
+// Every message code, and what its body decodes into. Messages that don't
+// have a body have a nil constructor.
+var messageTypes = map[int]func() proto.Message{
+	MsgErrorResp:         func() proto.Message { return &riak.RpbErrorResp{} },
+	MsgPingReq:           nil,
+	MsgPingResp:          nil,
+	MsgGetClientIdReq:    nil,
+	MsgGetClientIdResp:   func() proto.Message { return &riak.RpbGetClientIdResp{} },
+	MsgSetClientIdReq:    func() proto.Message { return &riak.RpbSetClientIdReq{} },
+	MsgSetClientIdResp:   nil,
+	MsgGetServerInfoReq:  nil,
+	MsgGetServerInfoResp: func() proto.Message { return &riak.RpbGetServerInfoResp{} },
+	MsgGetReq:            func() proto.Message { return &riak.RpbGetReq{} },
+	MsgGetResp:           func() proto.Message { return &riak.RpbGetResp{} },
+	MsgPutReq:            func() proto.Message { return &riak.RpbPutReq{} },
+	MsgPutResp:           func() proto.Message { return &riak.RpbPutResp{} },
+	MsgDelReq:            func() proto.Message { return &riak.RpbDelReq{} },
+	MsgDelResp:           nil,
+	MsgListBucketsReq:    nil,
+	MsgListBucketsResp:   func() proto.Message { return &riak.RpbListBucketsResp{} },
+	MsgListKeysReq:       func() proto.Message { return &riak.RpbListKeysReq{} },
+	MsgListKeysResp:      func() proto.Message { return &riak.RpbListKeysResp{} },
+	MsgGetBucketReq:      func() proto.Message { return &riak.RpbGetBucketReq{} },
+	MsgGetBucketResp:     func() proto.Message { return &riak.RpbGetBucketResp{} },
+	MsgSetBucketReq:      func() proto.Message { return &riak.RpbSetBucketReq{} },
+	MsgSetBucketResp:     nil,
+	MsgMapRedReq:         func() proto.Message { return &riak.RpbMapRedReq{} },
+	MsgMapRedResp:        func() proto.Message { return &riak.RpbMapRedResp{} },
+	MsgIndexReq:          func() proto.Message { return &riak.RpbIndexReq{} },
+	MsgIndexResp:         func() proto.Message { return &riak.RpbIndexResp{} },
+	MsgSearchQueryReq:    func() proto.Message { return &riak.RpbSearchQueryReq{} },
+	MsgSearchQueryResp:   func() proto.Message { return &riak.RpbSearchQueryResp{} },
+}
+
+// KnownCode tells if a message code is one we know about.
+func KnownCode(code int) bool {
+	_, ok := messageTypes[code]
+	return ok
+}
+
+// IsRequest tells if a message code is a request. Requests have odd codes,
+// and their responses are the next code up.
+func IsRequest(code int) bool {
+	return KnownCode(code) && code%2 == 1
+}
+
+// HasBody tells if messages with this code have a protobuf body. Ones that
+// don't (like ping) are just the code.
+func HasBody(code int) bool {
+	return messageTypes[code] != nil
+}
+
+// NewMessage returns an empty protobuf message of the type that goes with a
+// message code, or nil if the code has no body or isn't one we know about.
+func NewMessage(code int) proto.Message {
+	if newMsg := messageTypes[code]; newMsg != nil {
+		return newMsg()
+	}
+	return nil
+}
+
+// Decode unmarshals a message body into the protobuf type for its code. For
+// codes without a body it returns nil and no error.
+func Decode(code int, data []byte) (proto.Message, error) {
+	if !KnownCode(code) {
+		return nil, ErrUnknownCode
+	}
+	msg := NewMessage(code)
+	if msg == nil {
+		return nil, nil
+	}
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
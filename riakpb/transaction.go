@@ -0,0 +1,93 @@
+/*
+ * transaction.go
+ *
+ * A request paired up with its response, which for list keys and MapReduce
+ * is streamed over any number of frames.
+ *
+ */
+
+package riakpb
+
+import (
+	"time"
+)
+
+// A Transaction is a request and (once it has arrived) its response.
+type Transaction struct {
+	Code         int // of the request, the response is Code+1
+	Sent         time.Time
+	Request      *Request // nil if it couldn't be decoded
+	RequestBytes uint64   // of the body
+
+	// Streaming responses span several frames, these add up the ones seen
+	// so far. Response is the latest frame.
+	FirstFrame    time.Time
+	Completed     time.Time
+	Frames        uint64
+	ResponseBytes uint64
+	Items         uint64
+	Response      *Response
+}
+
+// NewTransaction starts a transaction for a request frame sent at the given
+// time. If the request can't be decoded the error is returned along with the
+// transaction, which can still be used to keep track of the response.
+func NewTransaction(ts time.Time, code int, data []byte) (*Transaction, error) {
+	t := &Transaction{Code: code, Sent: ts, RequestBytes: uint64(len(data))}
+	req, err := DecodeRequest(code, data)
+	t.Request = req
+	return t, err
+}
+
+// AddResponse adds a response frame received at the given time, and returns
+// true once the response is complete.
+//
+// If the frame isn't the response to this request (or an error) it returns
+// ErrUnexpectedResponse and the transaction is untouched; whoever is pairing
+// up requests and responses has lost their place. If it can't be decoded, the
+// transaction is completed with an outcome of "unknown" and the error is
+// returned too.
+func (t *Transaction) AddResponse(ts time.Time, code int, data []byte) (bool,
+	error) {
+	if code != MsgErrorResp && code != t.Code+1 {
+		return false, ErrUnexpectedResponse
+	}
+
+	res, err := DecodeResponse(code, data)
+	if err != nil {
+		res = &Response{Outcome: "unknown", Done: true}
+	}
+
+	if t.Frames == 0 {
+		t.FirstFrame = ts
+	}
+	t.Frames++
+	t.ResponseBytes += uint64(len(data))
+	t.Items += res.Items
+	t.Response = res
+	if res.Done {
+		t.Completed = ts
+	}
+	return res.Done, err
+}
+
+// Done tells if the whole response has arrived.
+func (t *Transaction) Done() bool {
+	return !t.Completed.IsZero()
+}
+
+// Streamed tells if the response came in more than one frame.
+func (t *Transaction) Streamed() bool {
+	return t.Frames > 1
+}
+
+// Latency is the time from the request to the last frame of the response.
+func (t *Transaction) Latency() time.Duration {
+	return t.Completed.Sub(t.Sent)
+}
+
+// FirstFrameLatency is the time from the request to the first frame of the
+// response.
+func (t *Transaction) FirstFrameLatency() time.Duration {
+	return t.FirstFrame.Sub(t.Sent)
+}
@@ -0,0 +1,147 @@
+package riakpb
+
+import (
+	"testing"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	riak "github.com/xb95/riak-sniffer/proto"
+)
+
+func TestTransaction(t *testing.T) {
+	sent := time.Unix(1000, 0)
+	getReq := body(t, &riak.RpbGetReq{Bucket: []byte("b"), Key: []byte("k")})
+	txn, err := NewTransaction(sent, MsgGetReq, getReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txn.Request.Method != "get" || txn.RequestBytes != uint64(len(getReq)) {
+		t.Errorf("request is %+v, %d bytes", txn.Request, txn.RequestBytes)
+	}
+	if txn.Done() {
+		t.Error("done before the response")
+	}
+
+	getResp := body(t, &riak.RpbGetResp{Content: []*riak.RpbContent{
+		{Value: []byte("hello")}}})
+	done, err := txn.AddResponse(sent.Add(3*time.Millisecond), MsgGetResp,
+		getResp)
+	if !done || err != nil {
+		t.Fatalf("AddResponse returned %v, %v", done, err)
+	}
+	if !txn.Done() || txn.Streamed() || txn.Frames != 1 {
+		t.Errorf("done %v, streamed %v, %d frames", txn.Done(), txn.Streamed(),
+			txn.Frames)
+	}
+	if txn.Response.Outcome != "found" ||
+		txn.ResponseBytes != uint64(len(getResp)) {
+		t.Errorf("response is %+v, %d bytes", txn.Response, txn.ResponseBytes)
+	}
+	if txn.Latency() != 3*time.Millisecond ||
+		txn.FirstFrameLatency() != 3*time.Millisecond {
+		t.Errorf("latency %s, first frame %s", txn.Latency(),
+			txn.FirstFrameLatency())
+	}
+}
+
+func TestTransactionStreaming(t *testing.T) {
+	sent := time.Unix(1000, 0)
+	txn, err := NewTransaction(sent, MsgListKeysReq,
+		body(t, &riak.RpbListKeysReq{Bucket: []byte("b")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames := []struct {
+		msg  *riak.RpbListKeysResp
+		done bool
+	}{
+		{&riak.RpbListKeysResp{Keys: [][]byte{[]byte("a"), []byte("b")}}, false},
+		{&riak.RpbListKeysResp{Keys: [][]byte{[]byte("c")}}, false},
+		{&riak.RpbListKeysResp{Done: proto.Bool(true)}, true},
+	}
+	var bytes uint64
+	for i, frame := range frames {
+		data := body(t, frame.msg)
+		bytes += uint64(len(data))
+		ts := sent.Add(time.Duration(i+1) * time.Millisecond)
+		done, err := txn.AddResponse(ts, MsgListKeysResp, data)
+		if done != frame.done || err != nil {
+			t.Fatalf("frame %d: AddResponse returned %v, %v", i, done, err)
+		}
+		if txn.Done() != frame.done {
+			t.Errorf("frame %d: Done() is %v", i, txn.Done())
+		}
+	}
+
+	if txn.Frames != 3 || txn.Items != 3 || txn.ResponseBytes != bytes {
+		t.Errorf("%d frames, %d items, %d bytes", txn.Frames, txn.Items,
+			txn.ResponseBytes)
+	}
+	if !txn.Streamed() {
+		t.Error("not streamed")
+	}
+	if txn.FirstFrameLatency() != time.Millisecond ||
+		txn.Latency() != 3*time.Millisecond {
+		t.Errorf("latency %s, first frame %s", txn.Latency(),
+			txn.FirstFrameLatency())
+	}
+}
+
+func TestTransactionUnexpected(t *testing.T) {
+	sent := time.Unix(1000, 0)
+	txn, err := NewTransaction(sent, MsgPingReq, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Somebody else's response doesn't count.
+	for _, code := range []int{MsgPingReq, MsgGetResp, 0x7f} {
+		done, err := txn.AddResponse(sent.Add(time.Millisecond), code, nil)
+		if done || err != ErrUnexpectedResponse {
+			t.Errorf("code %d: AddResponse returned %v, %v", code, done, err)
+		}
+	}
+	if txn.Frames != 0 || txn.Response != nil || txn.Done() {
+		t.Errorf("transaction was touched: %+v", txn)
+	}
+
+	// But an error always answers it.
+	errResp := body(t, &riak.RpbErrorResp{Errmsg: []byte("overload"),
+		Errcode: proto.Uint32(1)})
+	done, err := txn.AddResponse(sent.Add(2*time.Millisecond), MsgErrorResp,
+		errResp)
+	if !done || err != nil {
+		t.Fatalf("AddResponse returned %v, %v", done, err)
+	}
+	if txn.Response.Outcome != "error" ||
+		string(txn.Response.ErrMsg) != "overload" {
+		t.Errorf("response is %+v", txn.Response)
+	}
+	if txn.Latency() != 2*time.Millisecond {
+		t.Errorf("latency %s", txn.Latency())
+	}
+}
+
+func TestTransactionGarbage(t *testing.T) {
+	sent := time.Unix(1000, 0)
+
+	// A request we can't decode still gets a transaction to pair up with.
+	txn, err := NewTransaction(sent, MsgGetReq, []byte{0x0f, 0xff})
+	if err == nil {
+		t.Error("no error for a garbage request")
+	}
+	if txn == nil || txn.Request != nil || txn.RequestBytes != 2 {
+		t.Fatalf("transaction is %+v", txn)
+	}
+
+	// And a response we can't decode completes it as unknown.
+	done, err := txn.AddResponse(sent.Add(time.Millisecond), MsgGetResp,
+		[]byte{0x0f, 0xff})
+	if err == nil {
+		t.Error("no error for a garbage response")
+	}
+	if !done || !txn.Done() || txn.Response.Outcome != "unknown" {
+		t.Errorf("done %v, response %+v", done, txn.Response)
+	}
+}